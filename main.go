@@ -1,24 +1,38 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"embed"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"html/template"
 	"log"
 	"math"
+	"math/bits"
+	mrand "math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 //go:embed templates/*.html
@@ -29,6 +43,184 @@ var skillMD []byte
 
 var db *sql.DB
 
+// readDB serves listing queries for GET pages and endpoints. It is db unless
+// READ_DB_PATH points reads at a separate read-only connection. Anything that
+// reads back its own write keeps using db, since a replica may lag; the list
+// helpers take the handle to read from so each caller makes that choice.
+var readDB *sql.DB
+
+// --- Config ---
+
+// envInt reads a non-negative integer setting from the environment, falling back to def.
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v >= 0 {
+		return v
+	}
+	return def
+}
+
+// envDuration reads a non-negative duration such as "15m" or "90s" from the
+// environment, falling back to def.
+func envDuration(name string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil && v >= 0 {
+		return v
+	}
+	return def
+}
+
+// envFloat reads a non-negative number setting from the environment, falling back to def.
+func envFloat(name string, def float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil && v >= 0 {
+		return v
+	}
+	return def
+}
+
+// envString reads a setting from the environment, falling back to def when unset.
+// "none" clears it.
+func envString(name, def string) string {
+	switch v := os.Getenv(name); v {
+	case "":
+		return def
+	case "none":
+		return ""
+	default:
+		return v
+	}
+}
+
+// envBool reports whether a feature flag is switched on ("1" or "true").
+func envBool(name string) bool {
+	v := os.Getenv(name)
+	return v == "1" || v == "true"
+}
+
+// When set, project names must be unique (case-insensitively) as well as URLs.
+var uniqueNames = envBool("UNIQUE_NAMES")
+
+// Branding for self-hosted instances. INSTANCE_ICON=none drops the lobster.
+var (
+	instanceName = envString("INSTANCE_NAME", "MoltWiki")
+	instanceIcon = envString("INSTANCE_ICON", "🦞")
+)
+
+// URL prefix the site is mounted under behind a path-routing reverse proxy,
+// e.g. BASE_PATH=/wiki. Empty means the root.
+var basePath = strings.TrimRight(os.Getenv("BASE_PATH"), "/")
+
+// pathTo prefixes an absolute site path with basePath.
+func pathTo(p string) string {
+	return basePath + p
+}
+
+// underBasePath serves h at basePath with the prefix stripped, so routes stay
+// root-relative. The bare prefix redirects to its trailing-slash form.
+func underBasePath(h http.Handler) http.Handler {
+	if basePath == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			http.Redirect(w, r, basePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, basePath+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		http.StripPrefix(basePath, h).ServeHTTP(w, r)
+	})
+}
+
+// When set, projects can be submitted without an API key. They are attributed
+// to "anonymous" and rate-limited per IP instead of per agent.
+var allowAnonSubmit = envBool("ALLOW_ANON_SUBMIT")
+
+// Number of "broken" flags that triggers an automatic link check.
+var brokenFlagThreshold = envInt("BROKEN_FLAG_THRESHOLD", 3)
+
+// Number of agents that must suggest the same new URL before it replaces a project's URL.
+var urlSuggestionThreshold = envInt("URL_SUGGESTION_THRESHOLD", 3)
+
+// Vote burst detection: a project is marked suspicious when it receives at least
+// burstVotes votes within burstWindowMinutes from agents younger than burstAgentHours.
+var (
+	burstDetection     = envBool("BURST_DETECTION")
+	burstVotes         = envInt("BURST_VOTES", 5)
+	burstWindowMinutes = envInt("BURST_WINDOW_MINUTES", 10)
+	burstAgentHours    = envInt("BURST_AGENT_HOURS", 24)
+)
+
+// sqliteDriver is go-sqlite3 with the SQL functions our queries need that
+// SQLite doesn't build in by default.
+const sqliteDriver = "sqlite3_moltwiki"
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("log10", math.Log10, true)
+		},
+	})
+}
+
+// sqliteJournalModes are the values SQLITE_JOURNAL accepts.
+var sqliteJournalModes = map[string]bool{
+	"DELETE": true, "TRUNCATE": true, "PERSIST": true, "MEMORY": true, "WAL": true, "OFF": true,
+}
+
+// dbPath is the SQLite database file, from DB_PATH.
+func dbPath() string {
+	if path := os.Getenv("DB_PATH"); path != "" {
+		return path
+	}
+	return "./moltwiki.db"
+}
+
+// sqliteDSN builds the connection string from DB_PATH, SQLITE_JOURNAL and
+// SQLITE_BUSY_TIMEOUT (milliseconds), defaulting to ./moltwiki.db, WAL and 5000.
+func sqliteDSN() (string, error) {
+	journal := strings.ToUpper(os.Getenv("SQLITE_JOURNAL"))
+	if journal == "" {
+		journal = "WAL"
+	}
+	if !sqliteJournalModes[journal] {
+		return "", fmt.Errorf("invalid SQLITE_JOURNAL %q", os.Getenv("SQLITE_JOURNAL"))
+	}
+	timeout, err := sqliteBusyTimeout()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s?_journal_mode=%s&_busy_timeout=%d", dbPath(), journal, timeout), nil
+}
+
+func sqliteBusyTimeout() (int, error) {
+	v := os.Getenv("SQLITE_BUSY_TIMEOUT")
+	if v == "" {
+		return 5000, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid SQLITE_BUSY_TIMEOUT %q: must be a non-negative number of milliseconds", v)
+	}
+	return n, nil
+}
+
+// readDSN builds a read-only connection string for READ_DB_PATH, or returns
+// "" when it is unset and reads should share the primary connection. The
+// path may be a replica kept in sync by something like Litestream, or the
+// primary file itself to give reads their own connection pool.
+func readDSN() (string, error) {
+	path := os.Getenv("READ_DB_PATH")
+	if path == "" {
+		return "", nil
+	}
+	timeout, err := sqliteBusyTimeout()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("file:%s?mode=ro&_busy_timeout=%d", path, timeout), nil
+}
+
 // --- Request Tracking ---
 type RequestTracker struct {
 	mu         sync.Mutex
@@ -40,6 +232,198 @@ type RequestTracker struct {
 	endpoints  map[string]int64
 	recentIPs  map[string]bool
 	uniqueToday int64
+	latency    [len(latencyBuckets)]int64
+	timings    map[string]*endpointTiming
+	finished   []dailyTraffic // days rolled over but not yet persisted
+}
+
+// dailyTraffic is one UTC day's totals, as kept in traffic_daily.
+type dailyTraffic struct {
+	Day            string `json:"day"`
+	Requests       int64  `json:"requests"`
+	UniqueVisitors int64  `json:"unique_visitors"`
+}
+
+// endpointTiming accumulates response times for one normalized API path.
+type endpointTiming struct {
+	sum   time.Duration
+	count int64
+}
+
+// maxTrackedEndpoints caps how many distinct paths the tracker keeps, so
+// scanners probing random URLs can't grow its maps without bound. Paths
+// seen after the cap is reached are counted under otherEndpoint.
+const (
+	maxTrackedEndpoints = 200
+	otherEndpoint       = "(other)"
+)
+
+// trafficByMethod makes traffic breakdowns key on "METHOD path" so reads and writes to
+// the same endpoint are counted apart. Off by default, as it can double the keys.
+var trafficByMethod = envBool("TRAFFIC_BY_METHOD")
+
+// trafficKey is the endpoint r is counted under in the traffic breakdowns.
+func trafficKey(r *http.Request) string {
+	key := endpointKey(r.URL.Path)
+	if trafficByMethod {
+		key = r.Method + " " + key
+	}
+	return key
+}
+
+// endpointKey normalizes a request path for tracking:
+// /api/v1/projects/123/vote -> /api/v1/projects/*/vote
+func endpointKey(path string) string {
+	if !strings.HasPrefix(path, "/api/") {
+		return path
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) <= 4 {
+		return path
+	}
+	for i, p := range parts {
+		if _, err := strconv.Atoi(p); err == nil {
+			parts[i] = "*"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// latencyBuckets are the upper bounds of the API response time histogram;
+// the last bucket catches everything slower.
+var latencyBuckets = [...]struct {
+	label string
+	max   time.Duration
+}{
+	{"<10ms", 10 * time.Millisecond},
+	{"<50ms", 50 * time.Millisecond},
+	{"<200ms", 200 * time.Millisecond},
+	{"<1s", time.Second},
+	{">=1s", 0},
+}
+
+// statusRecorder remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// --- Request Logging ---
+
+// logSampleRate is the fraction of successful requests written to the request
+// log, from LOG_SAMPLE_RATE (0.0–1.0, default 1). Errors (4xx/5xx) bypass
+// sampling and are always logged.
+var logSampleRate = 1.0
+
+func parseLogSampleRate() error {
+	v := os.Getenv("LOG_SAMPLE_RATE")
+	if v == "" {
+		return nil
+	}
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return fmt.Errorf("invalid LOG_SAMPLE_RATE %q: must be between 0.0 and 1.0", v)
+	}
+	logSampleRate = rate
+	return nil
+}
+
+// logConfig logs the effective configuration once at startup as key=value
+// pairs, so operators can tell which settings and features are active.
+// Secrets are reported only as set or unset, and the webhook only by host.
+func logConfig(port string) {
+	secret := func(v string) string {
+		if v == "" {
+			return "unset"
+		}
+		return "set"
+	}
+	webhook := ""
+	if u, err := url.Parse(submissionWebhookURL); err == nil {
+		webhook = u.Host
+	}
+	settings := []struct {
+		key   string
+		value interface{}
+	}{
+		{"port", port},
+		{"base_path", basePath},
+		{"db_path", dbPath()},
+		{"read_db_path", os.Getenv("READ_DB_PATH")},
+		{"read_only", readOnly},
+		{"trusted_proxies", os.Getenv("TRUSTED_PROXIES")},
+		{"admin_key", secret(os.Getenv("ADMIN_KEY"))},
+		{"token_secret", secret(string(tokenSecret))},
+		{"rate_limits", rateLimits},
+		{"ip_rate_limits", ipRateLimits},
+		{"pow_difficulty", powDifficulty},
+		{"allow_anon_submit", allowAnonSubmit},
+		{"unique_names", uniqueNames},
+		{"agent_name_pattern", agentNamePatternString()},
+		{"max_projects_per_agent", maxProjectsPerAgent},
+		{"comment_cooldown", commentCooldown},
+		{"comment_edit_window", commentEditWindow},
+		{"vote_duplicate_window", voteDuplicateWindow},
+		{"auth_cache_ttl", authCacheTTL},
+		{"burst_detection", burstDetection},
+		{"default_sort", defaultSort},
+		{"max_page_size", maxPageSize},
+		{"list_max_tags", listMaxTags},
+		{"audit_log", auditLogEnabled},
+		{"similar_projects", similarProjectsEnabled},
+		{"submission_webhook", webhook},
+		{"public_url", publicURL},
+		{"traffic_by_method", trafficByMethod},
+		{"log_sample_rate", logSampleRate},
+	}
+	var b strings.Builder
+	for _, s := range settings {
+		if v, ok := s.value.(string); ok {
+			fmt.Fprintf(&b, " %s=%q", s.key, v)
+		} else {
+			fmt.Fprintf(&b, " %s=%v", s.key, s.value)
+		}
+	}
+	log.Printf("config%s", b.String())
+}
+
+// logRequest writes one key=value line per request, subject to sampling.
+func logRequest(r *http.Request, status int, d time.Duration) {
+	if status < 400 && (logSampleRate <= 0 || mrand.Float64() >= logSampleRate) {
+		return
+	}
+	log.Printf("request method=%s path=%q status=%d duration_ms=%.1f ip=%s",
+		r.Method, r.URL.Path, status, float64(d)/float64(time.Millisecond), clientIP(r))
+}
+
+// Observe adds an API response's duration to the histogram and to its
+// endpoint's running mean. Both reset with the daily counters in Track.
+func (t *RequestTracker) Observe(key string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timing := t.timings[key]
+	if timing == nil {
+		if len(t.timings) >= maxTrackedEndpoints {
+			key = otherEndpoint
+		}
+		if timing = t.timings[key]; timing == nil {
+			timing = &endpointTiming{}
+			t.timings[key] = timing
+		}
+	}
+	timing.sum += d
+	timing.count++
+	for i, b := range latencyBuckets {
+		if b.max == 0 || d < b.max {
+			t.latency[i]++
+			return
+		}
+	}
 }
 
 var tracker = &RequestTracker{
@@ -47,6 +431,42 @@ var tracker = &RequestTracker{
 	lastDay:   time.Now().Truncate(24 * time.Hour),
 	endpoints: make(map[string]int64),
 	recentIPs: make(map[string]bool),
+	timings:   make(map[string]*endpointTiming),
+}
+
+// Today returns the running totals for the current day.
+func (t *RequestTracker) Today() dailyTraffic {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return dailyTraffic{t.lastDay.UTC().Format("2006-01-02"), t.today, t.uniqueToday}
+}
+
+// trafficFlushInterval is how often daily totals are written to traffic_daily.
+const trafficFlushInterval = time.Minute
+
+// restoreTraffic picks up today's totals from traffic_daily so a restart
+// doesn't overwrite them with a fresh count. Visitors seen before the restart
+// may be counted again.
+func (t *RequestTracker) restoreTraffic() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	db.QueryRow("SELECT requests, unique_visitors FROM traffic_daily WHERE day = ?", t.lastDay.UTC().Format("2006-01-02")).
+		Scan(&t.today, &t.uniqueToday)
+}
+
+// runTrafficFlusher persists finished days and the running totals for today.
+func runTrafficFlusher() {
+	for range time.Tick(trafficFlushInterval) {
+		tracker.mu.Lock()
+		days := append(tracker.finished, dailyTraffic{tracker.lastDay.UTC().Format("2006-01-02"), tracker.today, tracker.uniqueToday})
+		tracker.finished = nil
+		tracker.mu.Unlock()
+		for _, d := range days {
+			db.Exec(`INSERT INTO traffic_daily (day, requests, unique_visitors) VALUES (?, ?, ?)
+				ON CONFLICT(day) DO UPDATE SET requests = excluded.requests, unique_visitors = excluded.unique_visitors`,
+				d.Day, d.Requests, d.UniqueVisitors)
+		}
+	}
 }
 
 func (t *RequestTracker) Track(r *http.Request) {
@@ -65,9 +485,12 @@ func (t *RequestTracker) Track(r *http.Request) {
 	// Reset daily counter
 	thisDay := now.Truncate(24 * time.Hour)
 	if thisDay.After(t.lastDay) {
+		t.finished = append(t.finished, dailyTraffic{t.lastDay.UTC().Format("2006-01-02"), t.today, t.uniqueToday})
 		t.today = 0
 		t.uniqueToday = 0
 		t.recentIPs = make(map[string]bool)
+		t.latency = [len(latencyBuckets)]int64{}
+		t.timings = make(map[string]*endpointTiming)
 		t.lastDay = thisDay
 	}
 
@@ -76,27 +499,14 @@ func (t *RequestTracker) Track(r *http.Request) {
 	t.hourly++
 
 	// Track endpoint
-	path := r.URL.Path
-	if strings.HasPrefix(path, "/api/") {
-		// Normalize API paths
-		parts := strings.Split(path, "/")
-		if len(parts) > 4 {
-			// /api/v1/projects/123/vote -> /api/v1/projects/*/vote
-			for i, p := range parts {
-				if _, err := strconv.Atoi(p); err == nil {
-					parts[i] = "*"
-				}
-			}
-			path = strings.Join(parts, "/")
-		}
+	path := trafficKey(r)
+	if _, ok := t.endpoints[path]; !ok && len(t.endpoints) >= maxTrackedEndpoints {
+		path = otherEndpoint
 	}
 	t.endpoints[path]++
 
 	// Track unique IPs
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		ip = r.RemoteAddr
-	}
+	ip := clientIP(r)
 	if !t.recentIPs[ip] {
 		t.recentIPs[ip] = true
 		t.uniqueToday++
@@ -112,42 +522,146 @@ func (t *RequestTracker) Stats() map[string]interface{} {
 		Path  string `json:"path"`
 		Count int64  `json:"count"`
 	}
-	var topEndpoints []ep
+	topEndpoints := make([]ep, 0, len(t.endpoints))
 	for p, c := range t.endpoints {
 		topEndpoints = append(topEndpoints, ep{p, c})
 	}
-	// Simple sort (top 10)
-	for i := 0; i < len(topEndpoints); i++ {
-		for j := i + 1; j < len(topEndpoints); j++ {
-			if topEndpoints[j].Count > topEndpoints[i].Count {
-				topEndpoints[i], topEndpoints[j] = topEndpoints[j], topEndpoints[i]
-			}
+	// Top 10 by count, ties broken by path so the output is stable
+	sort.Slice(topEndpoints, func(i, j int) bool {
+		if topEndpoints[i].Count != topEndpoints[j].Count {
+			return topEndpoints[i].Count > topEndpoints[j].Count
 		}
-	}
+		return topEndpoints[i].Path < topEndpoints[j].Path
+	})
 	if len(topEndpoints) > 10 {
 		topEndpoints = topEndpoints[:10]
 	}
 
+	// Response time histogram, fastest bucket first
+	type bucket struct {
+		Bucket string `json:"bucket"`
+		Count  int64  `json:"count"`
+	}
+	responseTimes := make([]bucket, len(latencyBuckets))
+	for i, b := range latencyBuckets {
+		responseTimes[i] = bucket{b.label, t.latency[i]}
+	}
+
+	// Slowest 10 endpoints by mean response time
+	type timing struct {
+		Path   string  `json:"path"`
+		Count  int64   `json:"count"`
+		MeanMs float64 `json:"mean_ms"`
+	}
+	slowest := make([]timing, 0, len(t.timings))
+	for p, et := range t.timings {
+		mean := float64(et.sum) / float64(et.count) / float64(time.Millisecond)
+		slowest = append(slowest, timing{p, et.count, math.Round(mean*100) / 100})
+	}
+	sort.Slice(slowest, func(i, j int) bool {
+		if slowest[i].MeanMs != slowest[j].MeanMs {
+			return slowest[i].MeanMs > slowest[j].MeanMs
+		}
+		return slowest[i].Path < slowest[j].Path
+	})
+	if len(slowest) > 10 {
+		slowest = slowest[:10]
+	}
+
 	return map[string]interface{}{
 		"requests_total":    t.total,
 		"requests_today":    t.today,
 		"requests_this_hour": t.hourly,
 		"unique_visitors_today": t.uniqueToday,
 		"top_endpoints":     topEndpoints,
+		"response_times_today": responseTimes,
+		"slowest_endpoints_today": slowest,
 	}
 }
 
 type Project struct {
-	ID           int       `json:"id"`
-	Name         string    `json:"name"`
-	URL          string    `json:"url"`
-	Description  string    `json:"description"`
-	SubmittedBy  string    `json:"submitted_by"`
-	Upvotes      int       `json:"upvotes"`
-	Downvotes    int       `json:"downvotes"`
-	Score        int       `json:"score"`
-	CommentCount int       `json:"comment_count"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID             int       `json:"id"`
+	Name           string    `json:"name"`
+	URL            string    `json:"url"`
+	Description    string    `json:"description"`
+	SubmittedBy    string    `json:"submitted_by"`
+	Upvotes        int       `json:"upvotes"`
+	Downvotes      int       `json:"downvotes"`
+	Score          float64   `json:"score"`
+	CommentCount   int       `json:"comment_count"`
+	Views          int       `json:"views"`
+	NSFW           bool      `json:"nsfw"`
+	LinkStatus     string    `json:"link_status"`
+	CommentsLocked bool      `json:"comments_locked"`
+	Tags           []string  `json:"tags"`
+	TagsTruncated  bool      `json:"tags_truncated,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+
+	RecentComments []Comment `json:"recent_comments,omitempty"`
+}
+
+// projectFields lists the Project JSON keys clients may pick with ?fields=.
+var projectFields = map[string]bool{
+	"id": true, "name": true, "url": true, "description": true, "submitted_by": true,
+	"upvotes": true, "downvotes": true, "score": true, "comment_count": true, "views": true,
+	"nsfw": true, "link_status": true, "comments_locked": true, "tags": true, "tags_truncated": true, "created_at": true, "recent_comments": true,
+}
+
+// descLimit reads ?truncate_desc=N for list responses; 0 means leave
+// descriptions whole, as does anything that isn't a positive integer.
+func descLimit(r *http.Request) int {
+	if n, err := strconv.Atoi(r.URL.Query().Get("truncate_desc")); err == nil && n > 0 {
+		return n
+	}
+	return 0
+}
+
+// truncateText shortens s to at most n characters, backing up to a word
+// boundary when there is one in the second half, and marks the cut with "…".
+func truncateText(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	cut := string(runes[:n])
+	if i := strings.LastIndexAny(cut, " \n\t"); i > len(cut)/2 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " \n\t.,;:") + "…"
+}
+
+// projectsResponse shapes a project list for the API: ?truncate_desc=N
+// shortens descriptions, and a sparse ?fields=a,b,c selection keeps only those
+// keys. Unknown names are ignored; with no known names the full projects are
+// returned.
+func projectsResponse(r *http.Request, projects []Project) interface{} {
+	if n := descLimit(r); n > 0 {
+		for i := range projects {
+			projects[i].Description = truncateText(projects[i].Description, n)
+		}
+	}
+	var keep []string
+	for _, f := range strings.Split(r.URL.Query().Get("fields"), ",") {
+		if f = strings.TrimSpace(f); projectFields[f] {
+			keep = append(keep, f)
+		}
+	}
+	if len(keep) == 0 {
+		return projects
+	}
+	out := make([]map[string]json.RawMessage, len(projects))
+	for i, p := range projects {
+		b, _ := json.Marshal(p)
+		var full map[string]json.RawMessage
+		json.Unmarshal(b, &full)
+		out[i] = make(map[string]json.RawMessage, len(keep))
+		for _, f := range keep {
+			if v, ok := full[f]; ok {
+				out[i][f] = v
+			}
+		}
+	}
+	return out
 }
 
 type Comment struct {
@@ -156,9 +670,41 @@ type Comment struct {
 	AgentName string    `json:"agent_name"`
 	AgentID   int       `json:"agent_id"`
 	Body      string    `json:"body"`
+	Pinned    bool      `json:"pinned"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// HistoryItem is one entry in an agent's activity timeline.
+type HistoryItem struct {
+	Type        string    `json:"type"`
+	ProjectID   int       `json:"project_id"`
+	ProjectName string    `json:"project_name"`
+	Vote        string    `json:"vote,omitempty"`
+	CommentID   int       `json:"comment_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ProjectVote is a vote someone cast on one of the caller's projects. The
+// voter is deliberately left out.
+type ProjectVote struct {
+	ProjectID   int       `json:"project_id"`
+	ProjectName string    `json:"project_name"`
+	Vote        string    `json:"vote"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Notification tells an agent about activity it asked to hear about.
+type Notification struct {
+	ID          int       `json:"id"`
+	Type        string    `json:"type"`
+	ProjectID   int       `json:"project_id"`
+	ProjectName string    `json:"project_name"`
+	CommentID   int       `json:"comment_id,omitempty"`
+	Actor       string    `json:"actor"`
+	Read        bool      `json:"read"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
 type Agent struct {
 	ID                int       `json:"id"`
 	Name              string    `json:"name"`
@@ -167,6 +713,9 @@ type Agent struct {
 	CreatedAt         time.Time `json:"created_at"`
 	ProjectsSubmitted int       `json:"projects_submitted,omitempty"`
 	VotesCast         int       `json:"votes_cast,omitempty"`
+
+	// Scope is what the credential used for this request may do; see authAgent.
+	Scope string `json:"-"`
 }
 
 type Stats struct {
@@ -176,893 +725,6262 @@ type Stats struct {
 }
 
 type Pagination struct {
-	Page       int
-	TotalPages int
-	HasPrev    bool
-	HasNext    bool
-	PrevPage   int
-	NextPage   int
-	Query      string
+	Page       int    `json:"page"`
+	TotalPages int    `json:"total_pages"`
+	HasPrev    bool   `json:"has_prev"`
+	HasNext    bool   `json:"has_next"`
+	PrevPage   int    `json:"prev_page"`
+	NextPage   int    `json:"next_page"`
+	Query      string `json:"query"`
+	Safe       bool   `json:"safe"`
+	Period     string `json:"period"`
+	Sort       string `json:"sort"`
 }
 
-const perPage = 20
-
-// --- Rate Limiting ---
-
-func checkRateLimit(agentID int, action string, maxPerHour int) bool {
-	var count int
-	db.QueryRow(
-		"SELECT COUNT(*) FROM rate_limits WHERE agent_id=? AND action_type=? AND created_at > datetime('now', '-1 hour')",
-		agentID, action,
-	).Scan(&count)
-	return count < maxPerHour
+// Link returns the home page URL for the current listing with one query
+// parameter changed (an empty value removes it). Changing anything but the
+// page starts over from page 1.
+func (p Pagination) Link(key, value string) string {
+	v := url.Values{}
+	if p.Query != "" {
+		v.Set("q", p.Query)
+	}
+	if p.Safe {
+		v.Set("safe", "true")
+	}
+	if p.Period != "" {
+		v.Set("period", p.Period)
+	}
+	if p.Sort != defaultSort {
+		v.Set("sort", p.Sort)
+	}
+	if value == "" {
+		v.Del(key)
+	} else {
+		v.Set(key, value)
+	}
+	if len(v) == 0 {
+		return pathTo("/")
+	}
+	return pathTo("/?" + v.Encode())
 }
 
-func recordAction(agentID int, action string) {
-	db.Exec("INSERT INTO rate_limits (agent_id, action_type) VALUES (?, ?)", agentID, action)
-	db.Exec("DELETE FROM rate_limits WHERE created_at < datetime('now', '-2 hours')")
+// ProjectFilter narrows the project listing shared by the home page, list and search endpoints.
+type ProjectFilter struct {
+	Search   string
+	SafeOnly bool
+	Period   string // a projectPeriods key; anything else means all time
+	Sort     string // a projectSorts key; anything else means defaultSort
+	MinScore *int
+	MaxScore *int
+	Tags     []string // normalized and distinct
+	AllTags  bool     // match projects carrying every tag rather than any
 }
 
-// --- Validation ---
+// projectPeriods maps each ?period= option to how far back created_at may go.
+var projectPeriods = map[string]string{
+	"week":  "-7 days",
+	"month": "-30 days",
+}
 
-func sanitize(s string) string {
-	return strings.TrimSpace(html.EscapeString(s))
+// periodLabels names the home page's time-window toggles; "" is all time.
+var periodLabels = map[string]string{
+	"":      "All time",
+	"month": "This month",
+	"week":  "This week",
 }
 
-func validateProjectInput(name, url, desc string) string {
-	if name == "" {
-		return "name is required"
+func (f ProjectFilter) where() (string, []interface{}) {
+	conds := []string{"deleted_at IS NULL"}
+	var args []interface{}
+	if f.Search != "" {
+		like := "%" + f.Search + "%"
+		conds = append(conds, "(name LIKE ? OR description LIKE ?)")
+		args = append(args, like, like)
 	}
-	if len(name) > 100 {
-		return "name must be 100 characters or less"
+	if f.SafeOnly {
+		conds = append(conds, "nsfw = 0")
 	}
-	if url == "" {
-		return "url is required"
+	if since, ok := projectPeriods[f.Period]; ok {
+		conds = append(conds, "created_at > datetime('now', ?)")
+		args = append(args, since)
 	}
-	if len(url) > 500 {
-		return "url must be 500 characters or less"
+	if f.MinScore != nil {
+		conds = append(conds, scoreSQL+" >= ?")
+		args = append(args, *f.MinScore)
 	}
-	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
-		return "url must start with http:// or https://"
+	if f.MaxScore != nil {
+		conds = append(conds, scoreSQL+" <= ?")
+		args = append(args, *f.MaxScore)
 	}
-	if len(desc) > 2000 {
-		return "description must be 2000 characters or less"
+	if len(f.Tags) > 0 {
+		tagged := "SELECT project_id FROM project_tags WHERE tag IN (" + strings.TrimSuffix(strings.Repeat("?,", len(f.Tags)), ",") + ")"
+		for _, t := range f.Tags {
+			args = append(args, t)
+		}
+		if f.AllTags {
+			tagged += " GROUP BY project_id HAVING COUNT(*) = ?"
+			args = append(args, len(f.Tags))
+		}
+		conds = append(conds, "id IN ("+tagged+")")
 	}
-	return ""
+	return " WHERE " + strings.Join(conds, " AND "), args
 }
 
-func validateAgentInput(name, desc string) string {
-	if name == "" {
-		return "name is required"
+// orderBy ranks results. When searching, projects whose name matches come
+// before ones that only match in the description.
+func (f ProjectFilter) orderBy() (string, []interface{}) {
+	order, ok := projectSorts[f.Sort]
+	if !ok {
+		order = projectSorts[defaultSort]
 	}
-	if len(name) > 50 {
-		return "name must be 50 characters or less"
+	if f.Search == "" {
+		return order, nil
 	}
-	if strings.ContainsAny(name, " \t\n\r") {
-		return "name cannot contain whitespace"
+	return "CASE WHEN name LIKE ? THEN 1 ELSE 0 END DESC, " + order, []interface{}{"%" + f.Search + "%"}
+}
+
+const perPage = 20
+
+// Field limits and page sizes. Validators, handlers and /capabilities all read these.
+const (
+	maxProjectNameLen = 100
+	maxProjectURLLen  = 500
+	maxProjectDescLen = 2000
+	maxAgentNameLen   = 50
+	maxAgentDescLen   = 500
+	maxCommentLen     = 1000
+	maxSearchQueryLen = 200
+	maxSourceLen      = 50
+
+	defaultPageSize  = 50
+	maxSearchResults = 50
+
+	maxPreviewComments = 3
+)
+
+// Minimum gap between one agent's comments, on top of the hourly cap.
+var commentCooldown = time.Duration(envInt("COMMENT_COOLDOWN_SEC", 0)) * time.Second
+
+// Lifetime cap on projects one agent may submit, removed ones included; 0 is unlimited.
+var maxProjectsPerAgent = envInt("MAX_PROJECTS_PER_AGENT", 0)
+
+// How long after posting an author may still edit a comment.
+var commentEditWindow = envDuration("COMMENT_EDIT_WINDOW", 15*time.Minute)
+
+// maxPageSize caps ?limit= on every paginated endpoint.
+var maxPageSize = envInt("MAX_PAGE_SIZE", 100)
+
+// pageParams reads ?limit= and ?offset=. A missing or invalid limit gets def;
+// one above maxPageSize is clamped to it.
+func pageParams(r *http.Request, def int) (limit, offset int) {
+	limit = min(def, maxPageSize)
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = min(l, maxPageSize)
 	}
-	if len(desc) > 500 {
-		return "description must be 500 characters or less"
+	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && o >= 0 {
+		offset = o
 	}
-	return ""
+	return limit, offset
 }
 
-func main() {
-	var err error
-	db, err = sql.Open("sqlite3", "./moltwiki.db?_journal_mode=WAL&_busy_timeout=5000")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
+// An identical comment from the same agent on the same project within this
+// window is treated as a retry of the first.
+const duplicateCommentWindow = 5 * time.Minute
 
-	initDB()
+// projectSorts maps each ?sort= option to its ORDER BY clause; see hotOrder
+// for "hot".
+var projectSorts = map[string]string{
+	"top": scoreSQL + " DESC, created_at DESC",
+	"hot": hotOrder(),
+	"new": "created_at DESC, id DESC",
+}
 
-	mux := http.NewServeMux()
+// A project's score is upvotes*UP_WEIGHT - downvotes*DOWN_WEIGHT; the raw
+// counts stay whole votes. Some communities weigh downvotes double, or less.
+var (
+	upWeight   = envFloat("UP_WEIGHT", 1)
+	downWeight = envFloat("DOWN_WEIGHT", 1)
+)
 
-	// Web routes
-	mux.HandleFunc("/", handleHome)
-	mux.HandleFunc("/project/", handleProject)
-	mux.HandleFunc("/submit", handleSubmit)
-	mux.HandleFunc("/search", handleSearch)
-	mux.HandleFunc("/skill.md", handleSkillMD)
+// scoreSQL is the score as SQL, used everywhere projects are scored, filtered
+// or ranked. With the default weights it's written exactly as
+// idx_projects_score's expression so the index applies.
+var scoreSQL = scoreExpr()
 
-	// API routes
-	mux.HandleFunc("/api/v1/agents/register", corsWrap(handleAPIRegister))
-	mux.HandleFunc("/api/v1/agents/me", corsWrap(handleAPIMe))
-	mux.HandleFunc("/api/v1/projects", corsWrap(handleAPIProjects))
-	mux.HandleFunc("/api/v1/projects/", corsWrap(handleAPIProjectRoute))
-	mux.HandleFunc("/api/v1/search", corsWrap(handleAPISearch))
-	mux.HandleFunc("/api/v1/traffic", corsWrap(handleAPITraffic))
+func scoreExpr() string {
+	if upWeight == 1 && downWeight == 1 {
+		return "(upvotes - downvotes)"
+	}
+	return fmt.Sprintf("(upvotes * %g - downvotes * %g)", upWeight, downWeight)
+}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+// voteWeight is how much a standing vote ("up", "down" or "" for none)
+// contributes to a project's score.
+func voteWeight(vote string) float64 {
+	switch vote {
+	case "up":
+		return upWeight
+	case "down":
+		return -downWeight
 	}
-	// Wrap mux with request tracking
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tracker.Track(r)
-		mux.ServeHTTP(w, r)
-	})
+	return 0
+}
+
+// The hot ranking is Reddit's: log10 of the score times HOT_SCORE_WEIGHT,
+// plus the submission time in units of HOT_DECAY_SECONDS. A project a decay
+// period newer ranks level with one whose score is 10x higher (with weight
+// 1), so a shorter decay ages projects out of the top faster and a higher
+// weight lets score hold them there longer. Downvoted projects sink the same
+// way.
+var (
+	hotDecaySeconds = envInt("HOT_DECAY_SECONDS", 45000)
+	hotScoreWeight  = envFloat("HOT_SCORE_WEIGHT", 1)
+)
 
-	log.Printf("🦞 MoltWiki running on http://localhost:%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, handler))
+func hotOrder() string {
+	return fmt.Sprintf("%g * (CASE WHEN %[2]s > 0 THEN 1 WHEN %[2]s < 0 THEN -1 ELSE 0 END)"+
+		" * log10(CAST(max(abs(%[2]s), 1) AS REAL)) + CAST(strftime('%%s', created_at) AS REAL) / %[3]d DESC, created_at DESC",
+		hotScoreWeight, scoreSQL, max(hotDecaySeconds, 1))
 }
 
-func corsWrap(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(204)
-			return
-		}
-		handler(w, r)
-	}
+// sortLabels names the home page's sort toggles.
+var sortLabels = map[string]string{
+	"hot": "Hot",
+	"new": "New",
+	"top": "Top",
 }
 
-func initDB() {
-	stmts := []string{
-		`CREATE TABLE IF NOT EXISTS agents (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT NOT NULL UNIQUE,
-			api_key TEXT UNIQUE NOT NULL,
-			description TEXT DEFAULT '',
-			created_at DATETIME DEFAULT (datetime('now'))
-		)`,
-		`CREATE TABLE IF NOT EXISTS projects (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT NOT NULL,
-			url TEXT NOT NULL UNIQUE,
-			description TEXT DEFAULT '',
-			submitted_by TEXT DEFAULT 'anonymous',
-			submitted_by_id INTEGER DEFAULT 0,
-			upvotes INTEGER DEFAULT 0,
-			downvotes INTEGER DEFAULT 0,
-			created_at DATETIME DEFAULT (datetime('now'))
-		)`,
-		`CREATE TABLE IF NOT EXISTS votes (
-			agent_id INTEGER NOT NULL,
-			project_id INTEGER NOT NULL,
-			vote_type TEXT NOT NULL CHECK(vote_type IN ('up','down')),
-			created_at DATETIME DEFAULT (datetime('now')),
-			PRIMARY KEY (agent_id, project_id),
-			FOREIGN KEY (agent_id) REFERENCES agents(id),
-			FOREIGN KEY (project_id) REFERENCES projects(id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS comments (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			project_id INTEGER NOT NULL,
-			agent_id INTEGER NOT NULL,
-			agent_name TEXT NOT NULL,
-			body TEXT NOT NULL,
-			created_at DATETIME DEFAULT (datetime('now')),
-			FOREIGN KEY (project_id) REFERENCES projects(id),
-			FOREIGN KEY (agent_id) REFERENCES agents(id)
-		)`,
-		`CREATE INDEX IF NOT EXISTS idx_comments_project ON comments(project_id, created_at)`,
-		`CREATE TABLE IF NOT EXISTS rate_limits (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			agent_id INTEGER NOT NULL,
-			action_type TEXT NOT NULL,
-			created_at DATETIME DEFAULT (datetime('now'))
-		)`,
-		`CREATE INDEX IF NOT EXISTS idx_rate_limits_lookup ON rate_limits(agent_id, action_type, created_at)`,
-		`CREATE INDEX IF NOT EXISTS idx_projects_score ON projects((upvotes - downvotes))`,
+// defaultSort orders listings that don't ask for a ?sort=. main refuses to
+// start if DEFAULT_SORT isn't a projectSorts key.
+var defaultSort = envString("DEFAULT_SORT", "top")
+
+// --- Rate Limiting ---
+
+// Hourly per-agent limits, keyed by rate_limits.action_type.
+var rateLimits = map[string]int{
+	"submit":  3,
+	"vote":    30,
+	"comment": 10,
+	"flag":    10,
+	"suggest": 10,
+	"render":  120,
+}
+
+func countRecentActions(agentID int, action string) int {
+	var count int
+	db.QueryRow(
+		"SELECT COUNT(*) FROM rate_limits WHERE agent_id=? AND action_type=? AND created_at > datetime('now', '-1 hour')",
+		agentID, action,
+	).Scan(&count)
+	return count
+}
+
+// recentActionWindow counts an agent's actions in the last hour like
+// countRecentActions, and also returns when the oldest of them leaves the
+// window (zero if there are none).
+func recentActionWindow(agentID int, action string) (int, time.Time) {
+	var count int
+	var oldest sql.NullString
+	db.QueryRow(
+		"SELECT COUNT(*), MIN(created_at) FROM rate_limits WHERE agent_id=? AND action_type=? AND created_at > datetime('now', '-1 hour')",
+		agentID, action,
+	).Scan(&count, &oldest)
+	if !oldest.Valid {
+		return count, time.Time{}
 	}
-	for _, s := range stmts {
-		if _, err := db.Exec(s); err != nil {
-			log.Fatal(err)
+	return count, parseTime(oldest.String).Add(time.Hour)
+}
+
+func checkRateLimit(agentID int, action string, maxPerHour int) bool {
+	return countRecentActions(agentID, action) < maxPerHour
+}
+
+func recordAction(agentID int, action string) {
+	db.Exec("INSERT INTO rate_limits (agent_id, action_type, created_at) VALUES (?, ?, ?)", agentID, action, dbNow())
+	db.Exec("DELETE FROM rate_limits WHERE created_at < datetime('now', '-2 hours')")
+}
+
+// Hourly per-IP limits for callers without an agent (registration, and
+// anonymous submissions when enabled), keyed by ip_rate_limits.action_type.
+var ipRateLimits = map[string]int{
+	"register": 5,
+	"submit":   1,
+}
+
+// Proxies whose X-Forwarded-For is believed, from TRUSTED_PROXIES
+// (comma-separated addresses or CIDRs). Empty means the header is ignored.
+var trustedProxies []*net.IPNet
+
+func loadTrustedProxies() error {
+	for _, v := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
 		}
-	}
-	// Seed if empty
-	var count int
-	db.QueryRow("SELECT COUNT(*) FROM projects").Scan(&count)
-	if count == 0 {
-		now := time.Now().UTC().Format("2006-01-02 15:04:05")
-		seeds := []struct{ name, url, desc string }{
-			{"Moltbook", "https://www.moltbook.com", "The social network for AI agents. Post, comment, upvote, create communities. The front page of the agent internet."},
-			{"Clawn.ch", "https://clawn.ch", "Skills and tools marketplace for AI agents."},
-			{"OpenWork", "https://openwork.bot", "Job board and work platform for AI agents."},
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
 		}
-		for _, s := range seeds {
-			db.Exec("INSERT INTO projects (name, url, description, submitted_by, upvotes, created_at) VALUES (?, ?, ?, 'moltwiki', 1, ?)",
-				s.name, s.url, s.desc, now)
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return fmt.Errorf("invalid TRUSTED_PROXIES entry %q", v)
 		}
-		log.Println("Seeded 3 default projects")
+		trustedProxies = append(trustedProxies, n)
 	}
+	return nil
 }
 
-// --- DB Helpers ---
-
-func parseTime(t string) time.Time {
-	formats := []string{
-		"2006-01-02 15:04:05",
-		"2006-01-02T15:04:05Z",
-		"2006-01-02 15:04:05+00:00",
-		"2006-01-02 15:04:05.000",
-		time.RFC3339,
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
 	}
-	for _, f := range formats {
-		if parsed, err := time.Parse(f, t); err == nil {
-			return parsed
+	for _, n := range trustedProxies {
+		if n.Contains(parsed) {
+			return true
 		}
 	}
-	return time.Now()
+	return false
 }
 
-const projectCols = "id, name, url, description, submitted_by, upvotes, downvotes, (upvotes - downvotes) as score, created_at"
-
-func scanProject(scanner interface{ Scan(...interface{}) error }) (*Project, error) {
-	var p Project
-	var t string
-	err := scanner.Scan(&p.ID, &p.Name, &p.URL, &p.Description, &p.SubmittedBy, &p.Upvotes, &p.Downvotes, &p.Score, &t)
-	if err != nil {
-		return nil, err
+// clientIP returns the caller's address: the connection's host, or, when that
+// host is a trusted proxy, the right-most X-Forwarded-For hop that isn't one.
+// Entries left of that are client-supplied and never believed.
+func clientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
 	}
-	p.CreatedAt = parseTime(t)
-	p.Name = html.UnescapeString(p.Name)
-	p.Description = html.UnescapeString(p.Description)
-	// Get comment count
-	db.QueryRow("SELECT COUNT(*) FROM comments WHERE project_id=?", p.ID).Scan(&p.CommentCount)
-	return &p, nil
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
 }
 
-func getProjectCount(search string) int {
+// checkIPRateLimit reports whether ip may perform action again, and if not,
+// how long until its oldest action in the window expires.
+func checkIPRateLimit(ip, action string, maxPerHour int) (bool, time.Duration) {
 	var count int
-	if search != "" {
-		like := "%" + search + "%"
-		db.QueryRow("SELECT COUNT(*) FROM projects WHERE name LIKE ? OR description LIKE ?", like, like).Scan(&count)
-	} else {
-		db.QueryRow("SELECT COUNT(*) FROM projects").Scan(&count)
+	var oldest sql.NullString
+	db.QueryRow(
+		"SELECT COUNT(*), MIN(created_at) FROM ip_rate_limits WHERE ip=? AND action_type=? AND created_at > datetime('now', '-1 hour')",
+		ip, action,
+	).Scan(&count, &oldest)
+	if count < maxPerHour {
+		return true, 0
 	}
-	return count
+	wait := time.Until(parseTime(oldest.String).Add(time.Hour))
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return false, wait
 }
 
-func getProjects(limit, offset int, search string) ([]Project, error) {
-	var rows *sql.Rows
-	var err error
-	if search != "" {
-		like := "%" + search + "%"
-		rows, err = db.Query(
-			"SELECT "+projectCols+" FROM projects WHERE name LIKE ? OR description LIKE ? ORDER BY (upvotes-downvotes) DESC, created_at DESC LIMIT ? OFFSET ?",
-			like, like, limit, offset,
-		)
-	} else {
-		rows, err = db.Query(
-			"SELECT "+projectCols+" FROM projects ORDER BY (upvotes-downvotes) DESC, created_at DESC LIMIT ? OFFSET ?",
-			limit, offset,
-		)
+func recordIPAction(ip, action string) {
+	db.Exec("INSERT INTO ip_rate_limits (ip, action_type, created_at) VALUES (?, ?, ?)", ip, action, dbNow())
+	db.Exec("DELETE FROM ip_rate_limits WHERE created_at < datetime('now', '-2 hours')")
+}
+
+// --- Audit Log ---
+
+// When set, mutating actions (registration, account deletion, project
+// create/edit, votes, comments) are recorded in audit_log. Unlike rate_limits
+// the log is never pruned.
+var auditLogEnabled = envBool("AUDIT_LOG")
+
+// audit appends an audit_log entry in tx, so it commits or rolls back with
+// the change it describes. target names the affected row, e.g. "project:3";
+// detail is stored as JSON.
+func audit(tx *sql.Tx, agentID int, action, target string, detail interface{}) error {
+	if !auditLogEnabled {
+		return nil
 	}
+	b, err := json.Marshal(detail)
 	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	var projects []Project
-	for rows.Next() {
-		p, err := scanProject(rows)
-		if err != nil {
-			return nil, err
-		}
-		projects = append(projects, *p)
+		return err
 	}
-	return projects, nil
+	_, err = tx.Exec("INSERT INTO audit_log (agent_id, action, target, detail, created_at) VALUES (?, ?, ?, ?, ?)",
+		agentID, action, target, string(b), dbNow())
+	return err
 }
 
-func getProject(id int) (*Project, error) {
-	row := db.QueryRow("SELECT "+projectCols+" FROM projects WHERE id=?", id)
-	return scanProject(row)
+func projectTarget(id int) string { return fmt.Sprintf("project:%d", id) }
+
+// --- Similar Projects ---
+
+// When set, /projects/{id}/similar ranks projects by TF-IDF cosine
+// similarity of their names and descriptions.
+var similarProjectsEnabled = envBool("SIMILAR_PROJECTS")
+
+const (
+	defaultSimilarProjects = 5
+	maxSimilarProjects     = 20
+)
+
+// similarIndex caches one unit-length TF-IDF vector per visible project. IDF
+// depends on the whole corpus, so any project change marks the entire index
+// stale and the next lookup rebuilds it.
+var similarIndex struct {
+	mu      sync.Mutex
+	stale   bool
+	vectors map[int]map[string]float64
 }
 
-func getComments(projectID int) ([]Comment, error) {
-	rows, err := db.Query(
-		"SELECT id, project_id, agent_id, agent_name, body, created_at FROM comments WHERE project_id=? ORDER BY created_at ASC",
-		projectID,
-	)
+// invalidateSimilar marks the similarity index for rebuilding after a project
+// is created, edited or removed.
+func invalidateSimilar() {
+	similarIndex.mu.Lock()
+	similarIndex.stale = true
+	similarIndex.mu.Unlock()
+}
+
+// Words too common to say anything about what a project does.
+var stopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "with": true, "that": true, "this": true,
+	"from": true, "your": true, "you": true, "are": true, "can": true, "its": true,
+	"into": true, "all": true, "any": true, "our": true, "has": true, "have": true,
+	"was": true, "not": true, "but": true, "use": true, "uses": true, "using": true,
+}
+
+// termCounts lowercases text, splits it on anything that isn't a letter or
+// digit and counts the words of three or more characters that aren't stop words.
+func termCounts(text string) map[string]int {
+	counts := make(map[string]int)
+	words := strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	for _, w := range words {
+		if len(w) >= 3 && !stopWords[w] {
+			counts[w]++
+		}
+	}
+	return counts
+}
+
+// buildSimilarIndex computes TF-IDF vectors for every visible project. It
+// reads the primary rather than the replica: a rebuild follows a write, and a
+// lagging replica would cache the index from before it until the next one.
+func buildSimilarIndex() (map[int]map[string]float64, error) {
+	rows, err := db.Query("SELECT id, name, description FROM projects WHERE deleted_at IS NULL")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var comments []Comment
+	docs := make(map[int]map[string]int)
+	df := make(map[string]int)
 	for rows.Next() {
-		var c Comment
-		var t string
-		if err := rows.Scan(&c.ID, &c.ProjectID, &c.AgentID, &c.AgentName, &c.Body, &t); err != nil {
+		var id int
+		var name, desc string
+		if err := rows.Scan(&id, &name, &desc); err != nil {
 			return nil, err
 		}
-		c.CreatedAt = parseTime(t)
-		c.Body = html.UnescapeString(c.Body)
-		comments = append(comments, c)
+		tc := termCounts(html.UnescapeString(name + " " + desc))
+		for t := range tc {
+			df[t]++
+		}
+		docs[id] = tc
 	}
-	return comments, nil
-}
-
-func getStats() Stats {
-	var s Stats
-	db.QueryRow("SELECT COUNT(*) FROM projects").Scan(&s.TotalProjects)
-	db.QueryRow("SELECT COUNT(*) FROM agents").Scan(&s.TotalAgents)
-	db.QueryRow("SELECT COUNT(*) FROM votes").Scan(&s.TotalVotes)
-	return s
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	n := float64(len(docs))
+	vectors := make(map[int]map[string]float64, len(docs))
+	for id, tc := range docs {
+		vec := make(map[string]float64, len(tc))
+		var norm float64
+		for t, c := range tc {
+			// Smoothed IDF keeps terms found in every project slightly positive.
+			w := float64(c) * (math.Log((1+n)/(1+float64(df[t]))) + 1)
+			vec[t] = w
+			norm += w * w
+		}
+		if norm > 0 {
+			norm = math.Sqrt(norm)
+			for t := range vec {
+				vec[t] /= norm
+			}
+		}
+		vectors[id] = vec
+	}
+	return vectors, nil
 }
 
-func authAgent(r *http.Request) (*Agent, error) {
-	auth := r.Header.Get("Authorization")
-	key := strings.TrimPrefix(auth, "Bearer ")
-	if key == "" || key == auth {
-		return nil, fmt.Errorf("missing or invalid Authorization header — use: Authorization: Bearer YOUR_API_KEY")
+// similarTo returns the ids of the projects most similar to projectID, with
+// their cosine similarity, best first. Projects sharing no terms are left out.
+func similarTo(projectID, limit int) ([]int, []float64, error) {
+	similarIndex.mu.Lock()
+	defer similarIndex.mu.Unlock()
+	if similarIndex.stale || similarIndex.vectors == nil {
+		vectors, err := buildSimilarIndex()
+		if err != nil {
+			return nil, nil, err
+		}
+		similarIndex.vectors, similarIndex.stale = vectors, false
 	}
-	var a Agent
-	var t string
-	err := db.QueryRow("SELECT id, name, api_key, description, created_at FROM agents WHERE api_key=?", key).
-		Scan(&a.ID, &a.Name, &a.APIKey, &a.Description, &t)
-	if err != nil {
-		return nil, fmt.Errorf("invalid API key")
+	target := similarIndex.vectors[projectID]
+	type match struct {
+		id    int
+		score float64
 	}
-	a.CreatedAt = parseTime(t)
-	return &a, nil
+	var matches []match
+	for id, vec := range similarIndex.vectors {
+		if id == projectID {
+			continue
+		}
+		var dot float64
+		for t, w := range target {
+			dot += w * vec[t]
+		}
+		if dot > 0 {
+			matches = append(matches, match{id, dot})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].id < matches[j].id
+	})
+	ids := make([]int, 0, limit)
+	scores := make([]float64, 0, limit)
+	for _, m := range matches {
+		if len(ids) == limit {
+			break
+		}
+		ids = append(ids, m.id)
+		scores = append(scores, m.score)
+	}
+	return ids, scores, nil
 }
 
-func generateAPIKey() string {
-	b := make([]byte, 20)
-	rand.Read(b)
-	return "moltwiki_" + hex.EncodeToString(b)
-}
+// --- Submission Approval ---
 
-func jsonResp(w http.ResponseWriter, status int, v interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(v)
+// When set, new projects are held for approval and POSTed to this URL; the
+// moderation system answers through /projects/{id}/moderation. When unset,
+// submissions go live immediately. A pending project is hidden exactly like a
+// deleted one (deleted_at is set) and also carries the approval_token the
+// moderation call must echo back.
+var submissionWebhookURL = os.Getenv("SUBMISSION_WEBHOOK_URL")
+
+// publicURL is the site's public origin (e.g. https://moltwiki.info), used to
+// give the webhook an absolute callback_url. Required with the webhook.
+var publicURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+
+// Undelivered pending projects are retried this often until the webhook
+// accepts them.
+const submissionRetryInterval = 5 * time.Minute
+
+// submissionWebhook is what the approval webhook receives.
+type submissionWebhook struct {
+	Project struct {
+		ID          int      `json:"id"`
+		Name        string   `json:"name"`
+		URL         string   `json:"url"`
+		Description string   `json:"description"`
+		SubmittedBy string   `json:"submitted_by"`
+		NSFW        bool     `json:"nsfw"`
+		Tags        []string `json:"tags"`
+	} `json:"project"`
+	Token       string `json:"token"`
+	CallbackURL string `json:"callback_url"`
 }
 
-func jsonErr(w http.ResponseWriter, status int, msg string) {
-	jsonResp(w, status, map[string]string{"error": msg})
+// validatePublicURL checks PUBLIC_URL, which the webhook needs for its
+// callback_url.
+func validatePublicURL() error {
+	if publicURL == "" {
+		if submissionWebhookURL != "" {
+			return fmt.Errorf("SUBMISSION_WEBHOOK_URL requires PUBLIC_URL")
+		}
+		return nil
+	}
+	u, err := url.Parse(publicURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+		return fmt.Errorf("invalid PUBLIC_URL %q: want an origin like https://example.com", publicURL)
+	}
+	return nil
 }
 
-// --- Template Rendering ---
+// submissionsInFlight keeps the submitter's goroutine and the retry loop from
+// delivering the same project at once.
+var submissionsInFlight = struct {
+	sync.Mutex
+	m map[int]bool
+}{m: map[int]bool{}}
 
-func renderPage(w http.ResponseWriter, page string, data interface{}) {
-	funcMap := template.FuncMap{
-		"add": func(a, b int) int { return a + b },
-		"sub": func(a, b int) int { return a - b },
-		"formatDate": func(t time.Time) string {
-			if t.Year() < 2000 {
-				return "—"
-			}
-			return t.Format("Jan 2, 2006")
-		},
-		"timeAgo": func(t time.Time) string {
-			if t.Year() < 2000 {
-				return "—"
+// deliverSubmission sends a pending project to the webhook, trying a few
+// times, and marks it delivered on success. Failures are logged and left for
+// runSubmissionRedelivery.
+func deliverSubmission(projectID int) {
+	submissionsInFlight.Lock()
+	if submissionsInFlight.m[projectID] {
+		submissionsInFlight.Unlock()
+		return
+	}
+	submissionsInFlight.m[projectID] = true
+	submissionsInFlight.Unlock()
+	defer func() {
+		submissionsInFlight.Lock()
+		delete(submissionsInFlight.m, projectID)
+		submissionsInFlight.Unlock()
+	}()
+
+	var payload submissionWebhook
+	p := &payload.Project
+	err := db.QueryRow(`SELECT id, name, url, description, submitted_by, nsfw, approval_token FROM projects
+		WHERE id = ? AND approval_token IS NOT NULL AND approval_sent_at IS NULL`, projectID).
+		Scan(&p.ID, &p.Name, &p.URL, &p.Description, &p.SubmittedBy, &p.NSFW, &payload.Token)
+	if err != nil {
+		return // moderated or delivered meanwhile
+	}
+	p.Name = html.UnescapeString(p.Name)
+	p.Description = html.UnescapeString(p.Description)
+	p.Tags = getProjectTags(db, p.ID)
+	payload.CallbackURL = publicURL + pathTo(fmt.Sprintf("%s/projects/%d/moderation", apiVersions["v1"], p.ID))
+	body, _ := json.Marshal(payload)
+	client := &http.Client{Timeout: 10 * time.Second}
+	for attempt := 1; attempt <= 3; attempt++ {
+		resp, err := client.Post(submissionWebhookURL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				db.Exec("UPDATE projects SET approval_sent_at = ? WHERE id = ?", dbNow(), projectID)
+				return
 			}
-			d := time.Since(t)
-			switch {
-			case d < time.Minute:
-				return "just now"
-			case d < time.Hour:
-				m := int(d.Minutes())
-				if m == 1 {
-					return "1 minute ago"
-				}
-				return fmt.Sprintf("%d minutes ago", m)
-			case d < 24*time.Hour:
-				h := int(d.Hours())
-				if h == 1 {
-					return "1 hour ago"
-				}
-				return fmt.Sprintf("%d hours ago", h)
-			default:
-				days := int(d.Hours() / 24)
-				if days == 1 {
-					return "1 day ago"
-				}
-				if days < 30 {
-					return fmt.Sprintf("%d days ago", days)
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		log.Printf("submission webhook for project %d failed (attempt %d): %v", projectID, attempt, err)
+		time.Sleep(time.Duration(attempt) * 2 * time.Second)
+	}
+	log.Printf("submission webhook for project %d undelivered; retrying in %s", projectID, submissionRetryInterval)
+}
+
+// runSubmissionRedelivery retries pending projects the webhook hasn't
+// accepted yet, including ones left over from before a restart.
+func runSubmissionRedelivery() {
+	for {
+		rows, err := db.Query("SELECT id FROM projects WHERE approval_token IS NOT NULL AND approval_sent_at IS NULL ORDER BY id")
+		if err == nil {
+			var ids []int
+			for rows.Next() {
+				var id int
+				if rows.Scan(&id) == nil {
+					ids = append(ids, id)
 				}
-				return t.Format("Jan 2, 2006")
 			}
-		},
-		"seq": func(n int) []int {
-			s := make([]int, n)
-			for i := range s {
-				s[i] = i + 1
+			rows.Close()
+			for _, id := range ids {
+				deliverSubmission(id)
 			}
-			return s
-		},
-	}
-	t, err := template.New("").Funcs(funcMap).ParseFS(templateFS, "templates/base.html", "templates/"+page+".html")
-	if err != nil {
-		http.Error(w, "template error: "+err.Error(), 500)
-		return
-	}
-	if err := t.ExecuteTemplate(w, "base", data); err != nil {
-		log.Printf("template render error: %v", err)
+		}
+		time.Sleep(submissionRetryInterval)
 	}
 }
 
-// --- Web Handlers ---
+// --- Link Checking ---
 
-func handleHome(w http.ResponseWriter, r *http.Request) {
+var flagReasons = map[string]bool{"spam": true, "broken": true, "inappropriate": true, "other": true}
+
+// linkCheckQueue feeds project ids to the background link checker.
+var linkCheckQueue = make(chan int, 100)
+
+func queueLinkCheck(projectID int) {
+	select {
+	case linkCheckQueue <- projectID:
+	default:
+		log.Printf("link check queue full, skipping project %d", projectID)
+	}
+}
+
+// errNonPublicAddress is returned when a checked link resolves to an address
+// the server shouldn't reach on a submitter's behalf.
+var errNonPublicAddress = errors.New("link resolves to a non-public address")
+
+// publicIP reports whether ip is routable on the public internet, so the link
+// checker can't be pointed at the server itself or its private network.
+func publicIP(ip net.IP) bool {
+	return ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast()
+}
+
+// linkCheckClient fetches submitted URLs. Every connection, including those
+// made to follow redirects, is refused unless it goes to a public address; the
+// check runs after DNS resolution so a hostname can't smuggle in a private one.
+func linkCheckClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicIP(net.ParseIP(host)) {
+				return errNonPublicAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 5 * time.Second},
+	}
+}
+
+func runLinkChecker() {
+	client := linkCheckClient()
+	for id := range linkCheckQueue {
+		var url string
+		if err := db.QueryRow("SELECT url FROM projects WHERE id=?", id).Scan(&url); err != nil {
+			continue
+		}
+		status := checkLink(client, url)
+		db.Exec("UPDATE projects SET link_status=?, link_checked_at=datetime('now') WHERE id=?", status, id)
+		log.Printf("link check: project %d (%s) is %s", id, url, status)
+	}
+}
+
+// checkLink returns "ok" or "broken" for url. Servers that reject HEAD get a GET instead.
+func checkLink(client *http.Client, url string) string {
+	resp, err := client.Head(url)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp.Body.Close()
+		resp, err = client.Get(url)
+	}
+	if err != nil {
+		return "broken"
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "broken"
+	}
+	return "ok"
+}
+
+// --- View Counting ---
+
+// A project view counts once per IP per viewDedupWindow. Counts collect in
+// memory and are written out every viewFlushInterval so reads never wait on a write.
+const (
+	viewDedupWindow   = 30 * time.Minute
+	viewFlushInterval = 10 * time.Second
+)
+
+var views = struct {
+	sync.Mutex
+	seen    map[string]time.Time // "ip|projectID" -> when it was counted
+	pending map[int]int
+}{seen: map[string]time.Time{}, pending: map[int]int{}}
+
+func recordView(r *http.Request, projectID int) {
+	key := clientIP(r) + "|" + strconv.Itoa(projectID)
+	now := time.Now()
+	views.Lock()
+	defer views.Unlock()
+	if last, ok := views.seen[key]; ok && now.Sub(last) < viewDedupWindow {
+		return
+	}
+	views.seen[key] = now
+	views.pending[projectID]++
+}
+
+func runViewFlusher() {
+	for range time.Tick(viewFlushInterval) {
+		views.Lock()
+		pending := views.pending
+		views.pending = map[int]int{}
+		now := time.Now()
+		for key, last := range views.seen {
+			if now.Sub(last) >= viewDedupWindow {
+				delete(views.seen, key)
+			}
+		}
+		views.Unlock()
+		for id, n := range pending {
+			db.Exec("UPDATE projects SET views = views + ? WHERE id = ?", n, id)
+		}
+	}
+}
+
+// --- Brigading Detection ---
+
+// checkVoteBurst marks a project suspicious for admin review when recently created
+// agents pile votes onto it. It never removes votes.
+func checkVoteBurst(projectID int) {
+	if !burstDetection {
+		return
+	}
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM votes v JOIN agents a ON a.id = v.agent_id
+		WHERE v.project_id = ?
+		AND v.created_at > datetime('now', ?)
+		AND a.created_at > datetime('now', ?)`,
+		projectID,
+		fmt.Sprintf("-%d minutes", burstWindowMinutes),
+		fmt.Sprintf("-%d hours", burstAgentHours),
+	).Scan(&n)
+	if n < burstVotes {
+		return
+	}
+	var changed int64
+	err := execWithRetry(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		res, err := tx.Exec("UPDATE projects SET suspicious = 1 WHERE id = ? AND suspicious = 0", projectID)
+		if err != nil {
+			return err
+		}
+		if changed, _ = res.RowsAffected(); changed == 0 {
+			return nil
+		}
+		if err := audit(tx, 0, "project.suspicious", projectTarget(projectID), map[string]int{"new_agent_votes": n}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		log.Printf("vote burst: marking project %d suspicious: %v", projectID, err)
+	} else if changed > 0 {
+		log.Printf("vote burst: project %d got %d votes from new agents, marked suspicious", projectID, n)
+	}
+}
+
+// --- Validation ---
+
+func sanitize(s string) string {
+	return strings.TrimSpace(html.EscapeString(s))
+}
+
+// Minimum description length for new projects; 0 keeps descriptions optional.
+var minDescriptionLen = envInt("MIN_DESCRIPTION_LEN", 0)
+
+// validateProjectInput returns an error message and the status to send with it,
+// or "" when the input is fine. Malformed input is a 400; input that is well
+// formed but fails a deployment's content policy is a 422.
+func validateProjectInput(name, url, desc string) (string, int) {
+	if name == "" {
+		return "name is required", 400
+	}
+	if len(name) > maxProjectNameLen {
+		return fmt.Sprintf("name must be %d characters or less", maxProjectNameLen), 400
+	}
+	if msg := validateURL(url); msg != "" {
+		return msg, 400
+	}
+	if len(desc) > maxProjectDescLen {
+		return fmt.Sprintf("description must be %d characters or less", maxProjectDescLen), 400
+	}
+	if len(desc) < minDescriptionLen {
+		return fmt.Sprintf("description must be at least %d characters", minDescriptionLen), 422
+	}
+	if containsBlockedTerm(name) || containsBlockedTerm(desc) {
+		return "name or description contains a blocked term", 422
+	}
+	return "", 0
+}
+
+// Banned words or phrases, from DENYLIST (comma-separated) and DENYLIST_PATH
+// (one per line, # for comments), compiled once at startup. Nil means none.
+var denylist *regexp.Regexp
+
+func loadDenylist() error {
+	terms := strings.Split(os.Getenv("DENYLIST"), ",")
+	if path := os.Getenv("DENYLIST_PATH"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading DENYLIST_PATH: %w", err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+				terms = append(terms, line)
+			}
+		}
+	}
+	var quoted []string
+	for _, t := range terms {
+		if t = strings.TrimSpace(t); t != "" {
+			quoted = append(quoted, regexp.QuoteMeta(t))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	// RE2's \b only knows ASCII word characters, so spell out the boundary.
+	denylist = regexp.MustCompile(`(?i)(?:^|[^\pL\pN_])(?:` + strings.Join(quoted, "|") + `)(?:$|[^\pL\pN_])`)
+	return nil
+}
+
+// containsBlockedTerm reports whether s contains a denylisted term as a whole word.
+func containsBlockedTerm(s string) bool {
+	return denylist != nil && denylist.MatchString(s)
+}
+
+func validateURL(u string) string {
+	if u == "" {
+		return "url is required"
+	}
+	if len(u) > maxProjectURLLen {
+		return fmt.Sprintf("url must be %d characters or less", maxProjectURLLen)
+	}
+	if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return "url must start with http:// or https://"
+	}
+	return ""
+}
+
+// normalizeURL lowercases the scheme and host and drops any #fragment, so
+// trivially different spellings of the same address compare equal.
+func normalizeURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	return u.String()
+}
+
+// Tag limits, tunable per deployment.
+var (
+	maxTagsPerProject = envInt("MAX_TAGS", 5)
+	maxTagLen         = envInt("MAX_TAG_LEN", 30)
+	listMaxTags       = envInt("LIST_MAX_TAGS", 5)
+)
+
+// capListTags trims each project's tags to the first LIST_MAX_TAGS
+// alphabetically for list responses, flagging the ones it cut. Single-project
+// endpoints keep the full set. Zero or less disables the cap.
+func capListTags(projects []Project) {
+	if listMaxTags <= 0 {
+		return
+	}
+	for i := range projects {
+		if len(projects[i].Tags) > listMaxTags {
+			projects[i].Tags = projects[i].Tags[:listMaxTags]
+			projects[i].TagsTruncated = true
+		}
+	}
+}
+
+// normalizeTag lowercases a tag, turns runs of whitespace into single hyphens
+// and strips hyphens from both ends, so "  Agent  Tools " becomes "agent-tools".
+func normalizeTag(t string) string {
+	t = strings.Join(strings.Fields(strings.ToLower(t)), "-")
+	return strings.Trim(t, "-")
+}
+
+// Most tags one listing query may filter on.
+const maxFilterTags = 10
+
+// parseTagFilter reads repeated ?tag= params and ?tag_mode=any|all (default
+// any) into f, returning an error message for a bad mode or too many tags.
+func parseTagFilter(q url.Values, f *ProjectFilter) string {
+	seen := make(map[string]bool)
+	for _, t := range q["tag"] {
+		if t = normalizeTag(t); t != "" && !seen[t] {
+			seen[t] = true
+			f.Tags = append(f.Tags, t)
+		}
+	}
+	if len(f.Tags) > maxFilterTags {
+		return fmt.Sprintf("at most %d tags per query", maxFilterTags)
+	}
+	switch q.Get("tag_mode") {
+	case "", "any":
+	case "all":
+		f.AllTags = true
+	default:
+		return "tag_mode must be 'any' or 'all'"
+	}
+	return ""
+}
+
+// validateTags normalizes and de-duplicates tags, returning an error
+// message if any tag is malformed or there are too many.
+func validateTags(tags []string) ([]string, string) {
+	seen := make(map[string]bool)
+	clean := []string{}
+	for _, t := range tags {
+		t = normalizeTag(t)
+		if t == "" {
+			return nil, "tags cannot be empty"
+		}
+		if len(t) > maxTagLen {
+			return nil, fmt.Sprintf("tags must be %d characters or less", maxTagLen)
+		}
+		for _, c := range t {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return nil, "tags may only contain letters, digits and hyphens"
+			}
+		}
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		clean = append(clean, t)
+	}
+	if len(clean) > maxTagsPerProject {
+		return nil, fmt.Sprintf("a project can have at most %d tags", maxTagsPerProject)
+	}
+	return clean, ""
+}
+
+// Optional agent-name character rule: AGENT_NAME_PATTERN (a regular
+// expression the whole name must match) or AGENT_NAME_STRICT=1 for ASCII
+// letters, digits, hyphens and underscores. Nil keeps the lenient default.
+var (
+	agentNamePattern *regexp.Regexp
+	agentNameRuleMsg string
+)
+
+func loadAgentNameRule() error {
+	if p := os.Getenv("AGENT_NAME_PATTERN"); p != "" {
+		re, err := regexp.Compile(`^(?:` + p + `)$`)
+		if err != nil {
+			return fmt.Errorf("invalid AGENT_NAME_PATTERN: %w", err)
+		}
+		agentNamePattern = re
+		agentNameRuleMsg = fmt.Sprintf("name must match the pattern %s", p)
+	} else if envBool("AGENT_NAME_STRICT") {
+		agentNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+		agentNameRuleMsg = "name may only contain letters (A-Z, a-z), digits, hyphens and underscores"
+	}
+	return nil
+}
+
+// agentNamePatternString is the active name rule for logging, or "" when none.
+func agentNamePatternString() string {
+	if agentNamePattern == nil {
+		return ""
+	}
+	return agentNamePattern.String()
+}
+
+func validateAgentInput(name, desc string) string {
+	if name == "" {
+		return "name is required"
+	}
+	if len(name) > maxAgentNameLen {
+		return fmt.Sprintf("name must be %d characters or less", maxAgentNameLen)
+	}
+	if strings.ContainsAny(name, " \t\n\r") {
+		return "name cannot contain whitespace"
+	}
+	if agentNamePattern != nil && !agentNamePattern.MatchString(name) {
+		return agentNameRuleMsg
+	}
+	if len(desc) > maxAgentDescLen {
+		return fmt.Sprintf("description must be %d characters or less", maxAgentDescLen)
+	}
+	return ""
+}
+
+func main() {
+	if maxPageSize < 1 {
+		log.Fatal("MAX_PAGE_SIZE must be at least 1")
+	}
+	if _, ok := projectSorts[defaultSort]; !ok {
+		log.Fatalf("invalid DEFAULT_SORT %q: must be one of top, hot, new", defaultSort)
+	}
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		log.Fatalf("invalid BASE_PATH %q: must start with /", basePath)
+	}
+	if hotDecaySeconds < 1 {
+		log.Fatal("HOT_DECAY_SECONDS must be at least 1")
+	}
+	if err := parseLogSampleRate(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadDenylist(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadAgentNameRule(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadTrustedProxies(); err != nil {
+		log.Fatal(err)
+	}
+	if err := validatePublicURL(); err != nil {
+		log.Fatal(err)
+	}
+	dsn, err := sqliteDSN()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err = sql.Open(sqliteDriver, dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	readDB = db
+	if rdsn, err := readDSN(); err != nil {
+		log.Fatal(err)
+	} else if rdsn != "" {
+		if readDB, err = sql.Open(sqliteDriver, rdsn); err != nil {
+			log.Fatal(err)
+		}
+		defer readDB.Close()
+	}
+
+	initDB()
+	go runLinkChecker()
+	go runViewFlusher()
+	tracker.restoreTraffic()
+	go runTrafficFlusher()
+	if submissionWebhookURL != "" {
+		go runSubmissionRedelivery()
+	}
+
+	mux := http.NewServeMux()
+
+	// Web routes
+	mux.HandleFunc("/", handleHome)
+	mux.HandleFunc("/project/", handleProject)
+	mux.HandleFunc("/submit", handleSubmit)
+	mux.HandleFunc("/search", handleSearch)
+	mux.HandleFunc("/skill.md", handleSkillMD)
+
+	// API routes
+	registerAPIv1(mux, apiVersions["v1"])
+	mux.HandleFunc("/api/", handleAPIUnversioned(mux))
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	// Wrap mux with request tracking
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tracker.Track(r)
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			tracker.Observe(trafficKey(r), elapsed)
+		}
+		logRequest(r, rec.status, elapsed)
+	})
+
+	logConfig(port)
+	log.Printf("%s running on http://localhost:%s%s/", strings.TrimSpace(instanceIcon+" "+instanceName), port, basePath)
+	log.Fatal(http.ListenAndServe(":"+port, underBasePath(handler)))
+}
+
+// --- API Versioning ---
+
+// apiVersions maps each API version to its route prefix. Versioned paths are
+// the canonical form; unversioned /api/... paths pick a version from the Accept
+// header (application/vnd.moltwiki.v1+json) or fall back to defaultAPIVersion.
+var apiVersions = map[string]string{
+	"v1": "/api/v1",
+}
+
+const defaultAPIVersion = "v1"
+
+func registerAPIv1(mux *http.ServeMux, prefix string) {
+	mux.HandleFunc(prefix+"/agents", corsWrap(handleAPIAgents))
+	mux.HandleFunc(prefix+"/agents/", corsWrap(handleAPIAgentRoute))
+	mux.HandleFunc(prefix+"/agents/register", corsWrap(handleAPIRegister))
+	mux.HandleFunc(prefix+"/agents/recent", corsWrap(handleAPIRecentAgents))
+	mux.HandleFunc(prefix+"/agents/challenge", corsWrap(handleAPIChallenge))
+	mux.HandleFunc(prefix+"/agents/me", corsWrap(handleAPIMe))
+	mux.HandleFunc(prefix+"/agents/token", corsWrap(handleAPIToken))
+	mux.HandleFunc(prefix+"/agents/me/usage", corsWrap(handleAPIMeUsage))
+	mux.HandleFunc(prefix+"/agents/me/limits", corsWrap(handleAPIMeLimits))
+	mux.HandleFunc(prefix+"/agents/me/keys", corsWrap(handleAPIKeys))
+	mux.HandleFunc(prefix+"/agents/me/history", corsWrap(handleAPIMeHistory))
+	mux.HandleFunc(prefix+"/agents/me/commented", corsWrap(handleAPIMeCommented))
+	mux.HandleFunc(prefix+"/agents/me/project-votes", corsWrap(handleAPIMeProjectVotes))
+	mux.HandleFunc(prefix+"/agents/me/votes/last", corsWrap(handleAPIUndoLastVote))
+	mux.HandleFunc(prefix+"/agents/me/notifications", corsWrap(handleAPINotifications))
+	mux.HandleFunc(prefix+"/agents/me/notifications/read", corsWrap(handleAPINotificationsRead))
+	mux.HandleFunc(prefix+"/projects", corsWrap(handleAPIProjects))
+	mux.HandleFunc(prefix+"/projects/", corsWrap(handleAPIProjectRoute))
+	mux.HandleFunc(prefix+"/projects/active", corsWrap(handleAPIActiveProjects))
+	mux.HandleFunc(prefix+"/projects/exists", corsWrap(handleAPIProjectExists))
+	mux.HandleFunc(prefix+"/projects/by-url", corsWrap(handleAPIProjectByURL))
+	mux.HandleFunc(prefix+"/projects/comment-counts", corsWrap(handleAPICommentCounts))
+	mux.HandleFunc(prefix+"/projects/compare", corsWrap(handleAPICompareProjects))
+	mux.HandleFunc(prefix+"/votes/batch", corsWrap(handleAPIVoteBatch))
+	mux.HandleFunc(prefix+"/contributors", corsWrap(handleAPIContributors))
+	mux.HandleFunc(prefix+"/tags/trending", corsWrap(handleAPITrendingTags))
+	mux.HandleFunc(prefix+"/search", corsWrap(handleAPISearch))
+	mux.HandleFunc(prefix+"/search/comments", corsWrap(handleAPISearchComments))
+	mux.HandleFunc(prefix+"/render/comment", corsWrap(handleAPIRenderComment))
+	mux.HandleFunc(prefix+"/traffic", corsWrap(handleAPITraffic))
+	mux.HandleFunc(prefix+"/traffic/history", corsWrap(handleAPITrafficHistory))
+	mux.HandleFunc(prefix+"/sentiment", corsWrap(handleAPISentiment))
+	mux.HandleFunc(prefix+"/capabilities", corsWrap(handleAPICapabilities))
+	mux.HandleFunc(prefix+"/admin/flags", corsWrap(handleAPIAdminFlags))
+	mux.HandleFunc(prefix+"/admin/stats", corsWrap(handleAPIAdminStats))
+	mux.HandleFunc(prefix+"/admin/agents", corsWrap(handleAPIAdminAgents))
+	mux.HandleFunc(prefix+"/admin/audit", corsWrap(handleAPIAdminAudit))
+	mux.HandleFunc(prefix+"/admin/maintenance", corsWrap(handleAPIAdminMaintenance))
+	mux.HandleFunc(prefix+"/admin/export", corsWrap(handleAPIAdminExport))
+	mux.HandleFunc(prefix+"/admin/import", corsWrap(handleAPIAdminImport))
+}
+
+// versionFromAccept extracts "v1" from an Accept header such as
+// "application/vnd.moltwiki.v1+json". It returns "" when none is requested.
+func versionFromAccept(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if v, ok := strings.CutPrefix(mediaType, "application/vnd.moltwiki."); ok {
+			return strings.TrimSuffix(v, "+json")
+		}
+	}
+	return ""
+}
+
+// handleAPIUnversioned re-dispatches /api/... requests without a version
+// segment to the version negotiated from the Accept header.
+func handleAPIUnversioned(mux *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, "/api")
+		for _, prefix := range apiVersions {
+			if strings.HasPrefix(r.URL.Path, prefix+"/") || r.URL.Path == prefix {
+				jsonErr(w, 404, "not found")
+				return
+			}
+		}
+		version := versionFromAccept(r.Header.Get("Accept"))
+		if version == "" {
+			version = defaultAPIVersion
+		}
+		prefix, ok := apiVersions[version]
+		if !ok {
+			jsonErr(w, 406, fmt.Sprintf("unsupported API version %q", version))
+			return
+		}
+		r.URL.Path = prefix + rest
+		mux.ServeHTTP(w, r)
+	}
+}
+
+// allowedOrigins restricts CORS to specific origins (comma-separated ALLOWED_ORIGINS).
+// When empty, any origin may call the API but credentials are not allowed.
+var allowedOrigins = parseOrigins(os.Getenv("ALLOWED_ORIGINS"))
+
+// readOnly pauses every API write (READ_ONLY=1) while reads keep working.
+// Admin maintenance still runs, since a read-only window is when it's wanted.
+var readOnly = envBool("READ_ONLY")
+
+// How long browsers may cache a preflight response, in seconds.
+var corsMaxAge = envInt("CORS_MAX_AGE", 600)
+
+func parseOrigins(v string) map[string]bool {
+	origins := make(map[string]bool)
+	for _, o := range strings.Split(v, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins[o] = true
+		}
+	}
+	return origins
+}
+
+func corsWrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if opts := (jsonWriter{w, r.URL.Query().Get("pretty") == "true", r.URL.Query().Get("relative") == "true"}); opts.pretty || opts.relative {
+			w = opts
+		}
+		if len(allowedOrigins) == 0 {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Add("Vary", "Origin")
+			if origin := r.Header.Get("Origin"); allowedOrigins[origin] {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+			w.WriteHeader(204)
+			return
+		}
+		if readOnly && r.Method != "GET" && r.Method != "HEAD" && !(strings.HasSuffix(r.URL.Path, "/admin/maintenance") && isAdmin(r)) {
+			jsonErrCode(w, 503, "read_only", instanceName+" is in read-only maintenance mode — writes are paused, please try again later")
+			return
+		}
+		if (r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH") && r.ContentLength != 0 && !isJSONContentType(r) {
+			jsonErr(w, 415, "Content-Type must be application/json")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func isJSONContentType(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+func initDB() {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS agents (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			api_key TEXT UNIQUE NOT NULL,
+			description TEXT DEFAULT '',
+			created_at DATETIME DEFAULT (datetime('now'))
+		)`,
+		`CREATE TABLE IF NOT EXISTS projects (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			url TEXT NOT NULL UNIQUE,
+			description TEXT DEFAULT '',
+			submitted_by TEXT DEFAULT 'anonymous',
+			submitted_by_id INTEGER DEFAULT 0,
+			upvotes INTEGER DEFAULT 0,
+			downvotes INTEGER DEFAULT 0,
+			created_at DATETIME DEFAULT (datetime('now'))
+		)`,
+		`CREATE TABLE IF NOT EXISTS votes (
+			agent_id INTEGER NOT NULL,
+			project_id INTEGER NOT NULL,
+			vote_type TEXT NOT NULL CHECK(vote_type IN ('up','down')),
+			created_at DATETIME DEFAULT (datetime('now')),
+			PRIMARY KEY (agent_id, project_id),
+			FOREIGN KEY (agent_id) REFERENCES agents(id),
+			FOREIGN KEY (project_id) REFERENCES projects(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS comments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			project_id INTEGER NOT NULL,
+			agent_id INTEGER NOT NULL,
+			agent_name TEXT NOT NULL,
+			body TEXT NOT NULL,
+			created_at DATETIME DEFAULT (datetime('now')),
+			FOREIGN KEY (project_id) REFERENCES projects(id),
+			FOREIGN KEY (agent_id) REFERENCES agents(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_comments_project ON comments(project_id, created_at)`,
+		`CREATE TABLE IF NOT EXISTS rate_limits (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id INTEGER NOT NULL,
+			action_type TEXT NOT NULL,
+			created_at DATETIME DEFAULT (datetime('now'))
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_rate_limits_lookup ON rate_limits(agent_id, action_type, created_at)`,
+		`CREATE TABLE IF NOT EXISTS ip_rate_limits (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ip TEXT NOT NULL,
+			action_type TEXT NOT NULL,
+			created_at DATETIME DEFAULT (datetime('now'))
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_ip_rate_limits_lookup ON ip_rate_limits(ip, action_type, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_projects_score ON projects((upvotes - downvotes))`,
+		`CREATE TABLE IF NOT EXISTS project_tags (
+			project_id INTEGER NOT NULL,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (project_id, tag),
+			FOREIGN KEY (project_id) REFERENCES projects(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_project_tags_tag ON project_tags(tag)`,
+		`CREATE TABLE IF NOT EXISTS subscriptions (
+			agent_id INTEGER NOT NULL,
+			project_id INTEGER NOT NULL,
+			created_at DATETIME DEFAULT (datetime('now')),
+			PRIMARY KEY (agent_id, project_id),
+			FOREIGN KEY (agent_id) REFERENCES agents(id),
+			FOREIGN KEY (project_id) REFERENCES projects(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_subscriptions_project ON subscriptions(project_id)`,
+		`CREATE TABLE IF NOT EXISTS notifications (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id INTEGER NOT NULL,
+			type TEXT NOT NULL,
+			project_id INTEGER NOT NULL,
+			comment_id INTEGER DEFAULT 0,
+			actor TEXT NOT NULL,
+			read_at DATETIME,
+			created_at DATETIME DEFAULT (datetime('now')),
+			FOREIGN KEY (agent_id) REFERENCES agents(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_notifications_agent ON notifications(agent_id, id)`,
+		`CREATE TABLE IF NOT EXISTS url_suggestions (
+			agent_id INTEGER NOT NULL,
+			project_id INTEGER NOT NULL,
+			url TEXT NOT NULL,
+			created_at DATETIME DEFAULT (datetime('now')),
+			PRIMARY KEY (agent_id, project_id),
+			FOREIGN KEY (agent_id) REFERENCES agents(id),
+			FOREIGN KEY (project_id) REFERENCES projects(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			key TEXT PRIMARY KEY,
+			agent_id INTEGER NOT NULL,
+			scope TEXT NOT NULL CHECK(scope IN ('read','full')),
+			created_at DATETIME DEFAULT (datetime('now')),
+			FOREIGN KEY (agent_id) REFERENCES agents(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_keys_agent ON api_keys(agent_id)`,
+		`CREATE TABLE IF NOT EXISTS flags (
+			agent_id INTEGER NOT NULL,
+			project_id INTEGER NOT NULL,
+			reason TEXT NOT NULL,
+			created_at DATETIME DEFAULT (datetime('now')),
+			PRIMARY KEY (agent_id, project_id),
+			FOREIGN KEY (agent_id) REFERENCES agents(id),
+			FOREIGN KEY (project_id) REFERENCES projects(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT NOT NULL,
+			detail TEXT DEFAULT '{}',
+			created_at DATETIME DEFAULT (datetime('now'))
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_agent ON audit_log(agent_id, id)`,
+		`CREATE TABLE IF NOT EXISTS traffic_daily (
+			day TEXT PRIMARY KEY,
+			requests INTEGER NOT NULL DEFAULT 0,
+			unique_visitors INTEGER NOT NULL DEFAULT 0
+		)`,
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Columns added after the initial schema; existing databases get them on startup.
+	addColumn("projects", "nsfw", "INTEGER DEFAULT 0")
+	addColumn("projects", "link_status", "TEXT DEFAULT 'unknown'")
+	addColumn("projects", "link_checked_at", "DATETIME")
+	addColumn("projects", "suspicious", "INTEGER DEFAULT 0")
+	addColumn("projects", "deleted_at", "DATETIME")
+	addColumn("projects", "source", "TEXT DEFAULT 'api'")
+	addColumn("projects", "views", "INTEGER DEFAULT 0")
+	addColumn("comments", "pinned", "INTEGER DEFAULT 0")
+	addColumn("agents", "retry_token_hash", "TEXT DEFAULT ''")
+	addColumn("projects", "comments_locked", "INTEGER DEFAULT 0")
+	addColumn("projects", "approval_token", "TEXT")
+	addColumn("votes", "updated_at", "DATETIME")
+	addColumn("projects", "approval_sent_at", "DATETIME")
+	if uniqueNames {
+		// Existing duplicates would make the index fail; the handler check still applies.
+		if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_projects_name_unique ON projects(LOWER(name))"); err != nil {
+			log.Printf("UNIQUE_NAMES: could not create name index (duplicate names already exist?): %v", err)
+		}
+	}
+	ensureSystemAgent()
+	// Seed if empty
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM projects").Scan(&count)
+	if count == 0 {
+		now := dbNow()
+		seeds := []struct{ name, url, desc string }{
+			{"Moltbook", "https://www.moltbook.com", "The social network for AI agents. Post, comment, upvote, create communities. The front page of the agent internet."},
+			{"Clawn.ch", "https://clawn.ch", "Skills and tools marketplace for AI agents."},
+			{"OpenWork", "https://openwork.bot", "Job board and work platform for AI agents."},
+		}
+		for _, s := range seeds {
+			db.Exec("INSERT INTO projects (name, url, description, submitted_by, submitted_by_id, upvotes, created_at) VALUES (?, ?, ?, ?, ?, 1, ?)",
+				s.name, s.url, s.desc, systemAgentName, systemAgentID, now)
+		}
+		log.Println("Seeded 3 default projects")
+	}
+}
+
+// The system agent owns the seeded projects so their submitter resolves like
+// any other. Its key starts with systemKeyPrefix, which authAgent refuses, so
+// nobody can act as it; it is left out of agent counts and listings.
+const (
+	systemAgentName = "moltwiki"
+	systemKeyPrefix = "system_"
+)
+
+var systemAgentID int
+
+// ensureSystemAgent creates the system agent if needed and attributes seeds
+// from before it existed. A real agent already registered under the name is
+// left alone, and seeds stay unattributed.
+func ensureSystemAgent() {
+	db.Exec("INSERT OR IGNORE INTO agents (name, api_key, description, created_at) VALUES (?, ?, ?, ?)",
+		systemAgentName, systemKeyPrefix+generateAPIKey(), "Seeds the directory.", dbNow())
+	var key string
+	db.QueryRow("SELECT id, api_key FROM agents WHERE name=?", systemAgentName).Scan(&systemAgentID, &key)
+	if !strings.HasPrefix(key, systemKeyPrefix) {
+		log.Printf("agent %q is a registered agent, not the system agent; seeded projects stay unattributed", systemAgentName)
+		systemAgentID = 0
+		return
+	}
+	db.Exec("UPDATE projects SET submitted_by_id=? WHERE submitted_by=? AND submitted_by_id=0", systemAgentID, systemAgentName)
+}
+
+// --- DB Helpers ---
+
+// addColumn adds a column to an existing table unless it is already there.
+func addColumn(table, column, def string) {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			log.Fatal(err)
+		}
+		if name == column {
+			return
+		}
+	}
+	rows.Close()
+	if _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + def); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// dbTimeFormat is the canonical UTC layout for every timestamp written to the
+// database. It matches SQLite's datetime('now'), so comparisons against
+// datetime('now', ...) keep working.
+const dbTimeFormat = "2006-01-02 15:04:05"
+
+func dbNow() string {
+	return time.Now().UTC().Format(dbTimeFormat)
+}
+
+// parseTime reads a stored timestamp as UTC. Rows written before timestamps
+// were canonicalized may use any of the older layouts.
+func parseTime(t string) time.Time {
+	formats := []string{
+		dbTimeFormat,
+		"2006-01-02T15:04:05Z",
+		"2006-01-02 15:04:05+00:00",
+		"2006-01-02 15:04:05.000",
+		time.RFC3339,
+	}
+	for _, f := range formats {
+		if parsed, err := time.Parse(f, t); err == nil {
+			return parsed.UTC()
+		}
+	}
+	return time.Now()
+}
+
+var projectCols = "id, name, url, description, submitted_by, upvotes, downvotes, " + scoreSQL + " as score, views, nsfw, link_status, comments_locked, created_at"
+
+// scanProject reads one projectCols row, loading its comment count and tags from q.
+func scanProject(q *sql.DB, scanner interface{ Scan(...interface{}) error }) (*Project, error) {
+	var p Project
+	var t string
+	err := scanner.Scan(&p.ID, &p.Name, &p.URL, &p.Description, &p.SubmittedBy, &p.Upvotes, &p.Downvotes, &p.Score, &p.Views, &p.NSFW, &p.LinkStatus, &p.CommentsLocked, &t)
+	if err != nil {
+		return nil, err
+	}
+	p.CreatedAt = parseTime(t)
+	p.Name = html.UnescapeString(p.Name)
+	p.Description = html.UnescapeString(p.Description)
+	// Get comment count
+	q.QueryRow("SELECT COUNT(*) FROM comments WHERE project_id=?", p.ID).Scan(&p.CommentCount)
+	p.Tags = getProjectTags(q, p.ID)
+	return &p, nil
+}
+
+func getProjectTags(q *sql.DB, projectID int) []string {
+	tags := []string{}
+	rows, err := q.Query("SELECT tag FROM project_tags WHERE project_id=? ORDER BY tag", projectID)
+	if err != nil {
+		return tags
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t string
+		if rows.Scan(&t) == nil {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// setProjectTags replaces a project's tag set within tx.
+func setProjectTags(tx *sql.Tx, projectID int, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM project_tags WHERE project_id=?", projectID); err != nil {
+		return err
+	}
+	for _, t := range tags {
+		if _, err := tx.Exec("INSERT INTO project_tags (project_id, tag) VALUES (?, ?)", projectID, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getProjectCount(q *sql.DB, f ProjectFilter) int {
+	var count int
+	where, args := f.where()
+	q.QueryRow("SELECT COUNT(*) FROM projects"+where, args...).Scan(&count)
+	return count
+}
+
+func getProjects(q *sql.DB, limit, offset int, f ProjectFilter) ([]Project, error) {
+	where, args := f.where()
+	order, orderArgs := f.orderBy()
+	args = append(append(args, orderArgs...), limit, offset)
+	rows, err := q.Query(
+		"SELECT "+projectCols+" FROM projects"+where+" ORDER BY "+order+" LIMIT ? OFFSET ?",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var projects []Project
+	for rows.Next() {
+		p, err := scanProject(q, rows)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, *p)
+	}
+	capListTags(projects)
+	return projects, rows.Err()
+}
+
+func getProject(id int) (*Project, error) {
+	row := db.QueryRow("SELECT "+projectCols+" FROM projects WHERE id=? AND deleted_at IS NULL", id)
+	return scanProject(db, row)
+}
+
+// CommentPage selects a slice of a project's comments. Comment ids only grow,
+// so After/Before act as stable cursors: pass the id of the last (or first)
+// comment you have. Without a cursor, Offset pages from the oldest comment.
+// A zero Limit returns everything.
+type CommentPage struct {
+	Limit  int
+	Offset int
+	Before int
+	After  int
+}
+
+func getComments(q *sql.DB, projectID int, page CommentPage) ([]Comment, error) {
+	limit := page.Limit
+	if limit == 0 {
+		limit = -1
+	}
+	query := "SELECT id, project_id, agent_id, agent_name, body, pinned, created_at FROM comments WHERE project_id=?"
+	args := []interface{}{projectID}
+	switch {
+	case page.After > 0:
+		query += " AND id > ? ORDER BY id ASC LIMIT ?"
+		args = append(args, page.After, limit)
+	case page.Before > 0:
+		// Take the newest comments before the cursor, then flip back to oldest-first.
+		query = "SELECT * FROM (" + query + " AND id < ? ORDER BY id DESC LIMIT ?) ORDER BY id ASC"
+		args = append(args, page.Before, limit)
+	default:
+		query += " ORDER BY pinned DESC, created_at ASC, id ASC LIMIT ? OFFSET ?"
+		args = append(args, limit, page.Offset)
+	}
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var comments []Comment
+	for rows.Next() {
+		var c Comment
+		var t string
+		if err := rows.Scan(&c.ID, &c.ProjectID, &c.AgentID, &c.AgentName, &c.Body, &c.Pinned, &t); err != nil {
+			return nil, err
+		}
+		c.CreatedAt = parseTime(t)
+		c.Body = html.UnescapeString(c.Body)
+		comments = append(comments, c)
+	}
+	return comments, nil
+}
+
+func getComment(id int) (*Comment, error) {
+	var c Comment
+	var t string
+	err := db.QueryRow("SELECT id, project_id, agent_id, agent_name, body, pinned, created_at FROM comments WHERE id=?", id).
+		Scan(&c.ID, &c.ProjectID, &c.AgentID, &c.AgentName, &c.Body, &c.Pinned, &t)
+	if err != nil {
+		return nil, err
+	}
+	c.CreatedAt = parseTime(t)
+	c.Body = html.UnescapeString(c.Body)
+	return &c, nil
+}
+
+// CommentWithProject is a comment listed outside its project, so it carries the project's name.
+type CommentWithProject struct {
+	Comment
+	ProjectName string `json:"project_name"`
+}
+
+// getCommentsWithProject lists comments on visible projects matching where
+// (which may refer to comments as c and projects as p), newest first.
+func getCommentsWithProject(q *sql.DB, where string, args []interface{}, limit, offset int) ([]CommentWithProject, error) {
+	rows, err := q.Query(`SELECT c.id, c.project_id, c.agent_id, c.agent_name, c.body, c.pinned, c.created_at, p.name
+		FROM comments c JOIN projects p ON p.id = c.project_id
+		WHERE p.deleted_at IS NULL AND `+where+` ORDER BY c.id DESC LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	comments := []CommentWithProject{}
+	for rows.Next() {
+		var c CommentWithProject
+		var t string
+		if err := rows.Scan(&c.ID, &c.ProjectID, &c.AgentID, &c.AgentName, &c.Body, &c.Pinned, &t, &c.ProjectName); err != nil {
+			return nil, err
+		}
+		c.CreatedAt = parseTime(t)
+		c.Body = html.UnescapeString(c.Body)
+		c.ProjectName = html.UnescapeString(c.ProjectName)
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// getRecentComments returns up to n of the newest comments for each project,
+// newest first, keyed by project id.
+func getRecentComments(q *sql.DB, projectIDs []int, n int) (map[int][]Comment, error) {
+	out := map[int][]Comment{}
+	if len(projectIDs) == 0 {
+		return out, nil
+	}
+	args := make([]interface{}, 0, len(projectIDs)+1)
+	for _, id := range projectIDs {
+		args = append(args, id)
+	}
+	args = append(args, n)
+	rows, err := q.Query(`
+		SELECT id, project_id, agent_id, agent_name, body, pinned, created_at FROM (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY project_id ORDER BY created_at DESC, id DESC) AS rn
+			FROM comments WHERE project_id IN (?`+strings.Repeat(",?", len(projectIDs)-1)+`)
+		) WHERE rn <= ? ORDER BY project_id, rn`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Comment
+		var t string
+		if err := rows.Scan(&c.ID, &c.ProjectID, &c.AgentID, &c.AgentName, &c.Body, &c.Pinned, &t); err != nil {
+			return nil, err
+		}
+		c.CreatedAt = parseTime(t)
+		c.Body = html.UnescapeString(c.Body)
+		out[c.ProjectID] = append(out[c.ProjectID], c)
+	}
+	return out, rows.Err()
+}
+
+func getStats(q *sql.DB) Stats {
+	var s Stats
+	q.QueryRow("SELECT COUNT(*) FROM projects WHERE deleted_at IS NULL").Scan(&s.TotalProjects)
+	q.QueryRow("SELECT COUNT(*) FROM agents WHERE id != ?", systemAgentID).Scan(&s.TotalAgents)
+	q.QueryRow("SELECT COUNT(*) FROM votes").Scan(&s.TotalVotes)
+	return s
+}
+
+// getAgentsByName loads public profiles (no api_key) for the given sanitized
+// names, keeping the caller's order. Names match case-insensitively, as they
+// do at registration.
+func getAgentsByName(q *sql.DB, names []string) ([]Agent, error) {
+	args := make([]interface{}, len(names))
+	for i, n := range names {
+		args[i] = n
+	}
+	rows, err := q.Query(`
+		SELECT a.id, a.name, a.description, a.created_at,
+			(SELECT COUNT(*) FROM projects p WHERE p.submitted_by_id = a.id AND p.deleted_at IS NULL),
+			(SELECT COUNT(*) FROM votes v WHERE v.agent_id = a.id)
+		FROM agents a WHERE LOWER(a.name) IN (LOWER(?)`+strings.Repeat(",LOWER(?)", len(names)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byName := map[string]Agent{}
+	for rows.Next() {
+		var a Agent
+		var t string
+		if err := rows.Scan(&a.ID, &a.Name, &a.Description, &t, &a.ProjectsSubmitted, &a.VotesCast); err != nil {
+			return nil, err
+		}
+		a.CreatedAt = parseTime(t)
+		byName[strings.ToLower(a.Name)] = a
+	}
+	agents := []Agent{}
+	for _, n := range names {
+		if a, ok := byName[strings.ToLower(n)]; ok {
+			a.Name = html.UnescapeString(a.Name)
+			a.Description = html.UnescapeString(a.Description)
+			agents = append(agents, a)
+		}
+	}
+	return agents, rows.Err()
+}
+
+// API key scopes. The key returned at registration is always full; extra
+// keys minted at /agents/me/keys may be read-only.
+const (
+	scopeRead = "read"
+	scopeFull = "full"
+)
+
+// errReadOnlyKey is returned by authAgent when a read-scoped key is used for
+// anything but GET; authErr turns it into a 403.
+var errReadOnlyKey = errors.New("this API key is read-only")
+
+// authCacheTTL is how long a resolved credential is reused before authAgent
+// looks it up again; 0 turns the cache off.
+var authCacheTTL = envDuration("AUTH_CACHE_TTL", 5*time.Second)
+
+// authCache maps bearer credentials to the agent they resolved to. gen is
+// bumped on every invalidation so a lookup that raced with a revocation
+// doesn't store what it read before the change.
+var authCache = struct {
+	sync.Mutex
+	m   map[string]cachedAuth
+	gen uint64
+}{m: map[string]cachedAuth{}}
+
+type cachedAuth struct {
+	agent Agent
+	at    time.Time
+}
+
+// cachedAgent returns a copy of the agent cached for key, if still fresh,
+// along with the cache generation to pass to cacheAgent.
+func cachedAgent(key string) (*Agent, uint64) {
+	authCache.Lock()
+	defer authCache.Unlock()
+	if c, ok := authCache.m[key]; ok && time.Since(c.at) < authCacheTTL {
+		a := c.agent
+		return &a, authCache.gen
+	}
+	return nil, authCache.gen
+}
+
+// cacheAgent stores a for key unless the cache was invalidated since gen, and
+// drops entries past the TTL.
+func cacheAgent(key string, a Agent, gen uint64) {
+	if authCacheTTL <= 0 {
+		return
+	}
+	authCache.Lock()
+	defer authCache.Unlock()
+	if gen != authCache.gen {
+		return
+	}
+	now := time.Now()
+	for k, c := range authCache.m {
+		if now.Sub(c.at) >= authCacheTTL {
+			delete(authCache.m, k)
+		}
+	}
+	authCache.m[key] = cachedAuth{a, now}
+}
+
+// invalidateAgentAuth forgets every cached credential of the agent. Call it
+// after revoking a key or deleting the account has committed.
+func invalidateAgentAuth(agentID int) {
+	authCache.Lock()
+	defer authCache.Unlock()
+	authCache.gen++
+	for k, c := range authCache.m {
+		if c.agent.ID == agentID {
+			delete(authCache.m, k)
+		}
+	}
+}
+
+// authAgent resolves the request's bearer credential — the agent's api_key,
+// an extra key from api_keys, or a signed token — to its agent. Read-scoped
+// keys are refused for any method that could write.
+func authAgent(r *http.Request) (*Agent, error) {
+	auth := r.Header.Get("Authorization")
+	key := strings.TrimPrefix(auth, "Bearer ")
+	if key == "" || key == auth {
+		return nil, fmt.Errorf("missing or invalid Authorization header — use: Authorization: Bearer YOUR_API_KEY")
+	}
+	if strings.HasPrefix(key, systemKeyPrefix) {
+		return nil, fmt.Errorf("invalid API key")
+	}
+	var claims *tokenClaims
+	if strings.HasPrefix(key, tokenPrefix) {
+		c, err := verifyToken(key)
+		if err != nil {
+			return nil, err
+		}
+		claims = &c
+	}
+	cached, gen := cachedAgent(key)
+	if cached != nil {
+		if cached.Scope == scopeRead && r.Method != "GET" && r.Method != "HEAD" {
+			return nil, errReadOnlyKey
+		}
+		return cached, nil
+	}
+	var a Agent
+	var t string
+	var err error
+	if claims != nil {
+		a, t, err = tokenAgent(*claims)
+	} else {
+		err = db.QueryRow("SELECT id, name, api_key, description, created_at, 'full' FROM agents WHERE api_key=?", key).
+			Scan(&a.ID, &a.Name, &a.APIKey, &a.Description, &t, &a.Scope)
+		if err == sql.ErrNoRows {
+			// An extra key stands in for the agent's own, which it must not reveal.
+			err = db.QueryRow(`SELECT a.id, a.name, k.key, a.description, a.created_at, k.scope
+				FROM api_keys k JOIN agents a ON a.id = k.agent_id WHERE k.key=?`, key).
+				Scan(&a.ID, &a.Name, &a.APIKey, &a.Description, &t, &a.Scope)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid API key")
+	}
+	a.CreatedAt = parseTime(t)
+	cacheAgent(key, a, gen)
+	if a.Scope == scopeRead && r.Method != "GET" && r.Method != "HEAD" {
+		return nil, errReadOnlyKey
+	}
+	return &a, nil
+}
+
+// authErr writes authAgent's failure: 403 for a read-only key used to write,
+// otherwise 401.
+func authErr(w http.ResponseWriter, err error) {
+	if err == errReadOnlyKey {
+		jsonErrCode(w, 403, "read_only_key", err.Error())
+		return
+	}
+	jsonErr(w, 401, err.Error())
+}
+
+// --- Signed Tokens ---
+
+// Short-lived tokens let clients avoid shipping their long-lived api_key.
+// A token is "mwt_" + base64url(claims) + "." + base64url(HMAC-SHA256(claims)),
+// signed with TOKEN_SECRET. Tokens are disabled when TOKEN_SECRET is unset.
+const tokenPrefix = "mwt_"
+
+var tokenSecret = []byte(os.Getenv("TOKEN_SECRET"))
+
+const (
+	defaultTokenTTL = time.Hour
+	maxTokenTTL     = 24 * time.Hour
+)
+
+// Kid identifies the key the token was minted with (see keyID), so revoking
+// that key revokes the token, and Scope is that key's scope.
+type tokenClaims struct {
+	Sub   int    `json:"sub"`
+	Kid   string `json:"kid"`
+	Scope string `json:"scope"`
+	Exp   int64  `json:"exp"`
+}
+
+// keyID is a non-secret identifier for an api key: a prefix of its SHA-256.
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+func signToken(agent *Agent, ttl time.Duration) (string, time.Time) {
+	exp := time.Now().Add(ttl).UTC()
+	claims, _ := json.Marshal(tokenClaims{Sub: agent.ID, Kid: keyID(agent.APIKey), Scope: agent.Scope, Exp: exp.Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(payload))
+	return tokenPrefix + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), exp
+}
+
+// verifyToken checks a token's signature and expiry and returns its claims.
+func verifyToken(token string) (tokenClaims, error) {
+	var c tokenClaims
+	if len(tokenSecret) == 0 {
+		return c, fmt.Errorf("tokens are not enabled on this server")
+	}
+	payload, sig, ok := strings.Cut(strings.TrimPrefix(token, tokenPrefix), ".")
+	if !ok {
+		return c, fmt.Errorf("invalid token")
+	}
+	gotSig, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return c, fmt.Errorf("invalid token")
+	}
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(payload))
+	if !hmac.Equal(gotSig, mac.Sum(nil)) {
+		return c, fmt.Errorf("invalid token")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return c, fmt.Errorf("invalid token")
+	}
+	if err := json.Unmarshal(raw, &c); err != nil || c.Kid == "" {
+		return c, fmt.Errorf("invalid token")
+	}
+	if time.Now().Unix() >= c.Exp {
+		return c, fmt.Errorf("token expired")
+	}
+	return c, nil
+}
+
+// tokenAgent resolves verified claims to the agent, provided the key the
+// token was minted with still exists. The agent carries that key and its
+// scope, never the registration key when an extra key was used.
+func tokenAgent(c tokenClaims) (Agent, string, error) {
+	var a Agent
+	var t string
+	err := db.QueryRow("SELECT id, name, api_key, description, created_at FROM agents WHERE id=?", c.Sub).
+		Scan(&a.ID, &a.Name, &a.APIKey, &a.Description, &t)
+	if err != nil {
+		return a, t, err
+	}
+	if keyID(a.APIKey) == c.Kid {
+		a.Scope = scopeFull
+		return a, t, nil
+	}
+	rows, err := db.Query("SELECT key, scope FROM api_keys WHERE agent_id=?", a.ID)
+	if err != nil {
+		return a, t, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, scope string
+		if rows.Scan(&key, &scope) == nil && keyID(key) == c.Kid {
+			a.APIKey, a.Scope = key, scope
+			return a, t, nil
+		}
+	}
+	return a, t, sql.ErrNoRows
+}
+
+// --- Proof of Work ---
+
+// With POW_DIFFICULTY > 0, registration requires solving a challenge from
+// GET /agents/challenge: a nonce such that SHA-256(challenge + nonce) starts
+// with at least POW_DIFFICULTY zero bits. Challenges are single-use and expire.
+var powDifficulty = envInt("POW_DIFFICULTY", 0)
+
+const (
+	powChallengeTTL     = 5 * time.Minute
+	maxPendingChallenge = 10000
+)
+
+var powChallenges = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: map[string]time.Time{}}
+
+// newPowChallenge issues a challenge, or "" if too many are outstanding.
+func newPowChallenge() (string, time.Time) {
+	powChallenges.Lock()
+	defer powChallenges.Unlock()
+	now := time.Now()
+	for c, exp := range powChallenges.m {
+		if now.After(exp) {
+			delete(powChallenges.m, c)
+		}
+	}
+	if len(powChallenges.m) >= maxPendingChallenge {
+		return "", time.Time{}
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	c := hex.EncodeToString(b)
+	exp := now.Add(powChallengeTTL).UTC()
+	powChallenges.m[c] = exp
+	return c, exp
+}
+
+// verifyPow consumes challenge and checks nonce against the current difficulty.
+func verifyPow(challenge, nonce string) string {
+	powChallenges.Lock()
+	exp, ok := powChallenges.m[challenge]
+	delete(powChallenges.m, challenge)
+	powChallenges.Unlock()
+	if !ok || time.Now().After(exp) {
+		return "unknown or expired challenge — get a new one from /agents/challenge"
+	}
+	sum := sha256.Sum256([]byte(challenge + nonce))
+	zeros := 0
+	for _, b := range sum {
+		if b != 0 {
+			zeros += bits.LeadingZeros8(b)
+			break
+		}
+		zeros += 8
+	}
+	if zeros < powDifficulty {
+		return fmt.Sprintf("nonce does not solve the challenge (need %d leading zero bits)", powDifficulty)
+	}
+	return ""
+}
+
+func handleAPIChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	if powDifficulty == 0 {
+		jsonErr(w, 404, "proof-of-work is not enabled on this server")
+		return
+	}
+	challenge, exp := newPowChallenge()
+	if challenge == "" {
+		jsonErr(w, 503, "too many outstanding challenges, try again shortly")
+		return
+	}
+	jsonResp(w, 200, map[string]interface{}{
+		"challenge":  challenge,
+		"difficulty": powDifficulty,
+		"expires_at": exp,
+	})
+}
+
+func generateAPIKey() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return "moltwiki_" + hex.EncodeToString(b)
+}
+
+// prettyJSON indents every JSON response; ?pretty=true does the same per request.
+var prettyJSON = envBool("PRETTY_JSON")
+
+// jsonWriter carries per-request output options for jsonResp: ?pretty=true
+// indents the JSON and ?relative=true adds created_ago next to each
+// created_at. corsWrap applies it so handlers don't need the request.
+type jsonWriter struct {
+	http.ResponseWriter
+	pretty   bool
+	relative bool
+}
+
+func jsonResp(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	opts, _ := w.(jsonWriter)
+	if !opts.relative {
+		enc := json.NewEncoder(w)
+		if opts.pretty || prettyJSON {
+			enc.SetIndent("", "  ")
+		}
+		enc.Encode(v)
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	b = addRelativeTimes(b)
+	if opts.pretty || prettyJSON {
+		var out bytes.Buffer
+		json.Indent(&out, b, "", "  ")
+		b = out.Bytes()
+	}
+	w.Write(append(b, '\n'))
+}
+
+// createdAtField matches a created_at key in compact JSON. Quotes inside JSON
+// strings are always escaped, so this can't match within a value.
+var createdAtField = regexp.MustCompile(`"created_at":"([^"]*)"`)
+
+// addRelativeTimes follows every created_at in b with a created_ago rendered
+// by timeAgo, as the HTML pages show it.
+func addRelativeTimes(b []byte) []byte {
+	return createdAtField.ReplaceAllFunc(b, func(m []byte) []byte {
+		t := parseTime(string(createdAtField.FindSubmatch(m)[1]))
+		ago, _ := json.Marshal(timeAgo(t))
+		out := append([]byte{}, m...)
+		return append(append(out, `,"created_ago":`...), ago...)
+	})
+}
+
+// errorCodes gives each status a default machine-readable error code. Call
+// sites with a more specific case use jsonErrCode instead.
+var errorCodes = map[int]string{
+	400: "validation_failed",
+	401: "unauthorized",
+	403: "forbidden",
+	404: "not_found",
+	405: "method_not_allowed",
+	406: "not_acceptable",
+	409: "conflict",
+	415: "unsupported_media_type",
+	422: "validation_failed",
+	429: "rate_limited",
+	500: "internal_error",
+	503: "unavailable",
+}
+
+func jsonErr(w http.ResponseWriter, status int, msg string) {
+	jsonErrCode(w, status, errorCodes[status], msg)
+}
+
+// jsonErrCode writes {"error": msg, "code": code}. Clients should branch on
+// code; msg is for humans and may change.
+func jsonErrCode(w http.ResponseWriter, status int, code, msg string) {
+	jsonResp(w, status, map[string]string{"error": msg, "code": code})
+}
+
+// --- Write Retries ---
+
+// SQLite can still report the database busy once SQLITE_BUSY_TIMEOUT runs out
+// under heavy write contention. execWithRetry gives such writes a few more
+// tries before the handler gives up with a 503.
+const (
+	writeRetries      = 3
+	writeRetryBackoff = 50 * time.Millisecond
+)
+
+// isBusy reports whether err is SQLite's busy or locked error.
+func isBusy(err error) bool {
+	var se sqlite3.Error
+	return errors.As(err, &se) && (se.Code == sqlite3.ErrBusy || se.Code == sqlite3.ErrLocked)
+}
+
+// execWithRetry runs fn, running it again with a growing backoff while it
+// fails because the database is busy. fn must be safe to repeat, e.g. a
+// single statement or a whole transaction that rolls back on error.
+func execWithRetry(fn func() error) error {
+	err := fn()
+	for i := 1; i <= writeRetries && isBusy(err); i++ {
+		time.Sleep(time.Duration(i) * writeRetryBackoff)
+		err = fn()
+	}
+	return err
+}
+
+// writeErr reports a failed write: 503 with Retry-After if the database stayed
+// busy through every retry, otherwise 500 with msg.
+func writeErr(w http.ResponseWriter, err error, msg string) {
+	if isBusy(err) {
+		w.Header().Set("Retry-After", "1")
+		jsonErrCode(w, 503, "database_busy", "database is busy, please retry shortly")
+		return
+	}
+	jsonErr(w, 500, msg)
+}
+
+// --- Markdown ---
+
+var (
+	mdLink   = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^\s)]+)\)`)
+	mdBold   = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	mdItalic = regexp.MustCompile(`\*([^*]+)\*`)
+	mdParas  = regexp.MustCompile(`\n\s*\n`)
+)
+
+// renderMarkdown turns a comment body into HTML. The text is escaped first, so
+// only the small subset produced here can reach the page: paragraphs, line
+// breaks, `code`, **bold**, *italic* and [links](https://...).
+func renderMarkdown(body string) template.HTML {
+	var out strings.Builder
+	for _, para := range mdParas.Split(strings.TrimSpace(body), -1) {
+		if para == "" {
+			continue
+		}
+		out.WriteString("<p>")
+		// Odd segments sit between backticks and are rendered verbatim as code.
+		for i, seg := range strings.Split(para, "`") {
+			seg = html.EscapeString(seg)
+			if i%2 == 1 {
+				out.WriteString("<code>" + seg + "</code>")
+				continue
+			}
+			seg = mdLink.ReplaceAllString(seg, `<a href="$2" rel="nofollow noopener" target="_blank">$1</a>`)
+			seg = mdBold.ReplaceAllString(seg, "<strong>$1</strong>")
+			seg = mdItalic.ReplaceAllString(seg, "<em>$1</em>")
+			out.WriteString(strings.ReplaceAll(seg, "\n", "<br>"))
+		}
+		out.WriteString("</p>")
+	}
+	return template.HTML(out.String())
+}
+
+// --- Template Rendering ---
+
+// Security headers for the HTML pages. The default CSP allows the templates'
+// inline styles and data: favicon but no scripts, plugins or framing. Set
+// CONTENT_SECURITY_POLICY or FRAME_OPTIONS (e.g. SAMEORIGIN) to loosen them
+// for embedding (both, since the CSP's frame-ancestors also applies), or to
+// "none" to drop the header. API responses never get these.
+var (
+	contentSecurityPolicy = envString("CONTENT_SECURITY_POLICY",
+		"default-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; script-src 'none'; object-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'")
+	frameOptions   = envString("FRAME_OPTIONS", "DENY")
+	referrerPolicy = envString("REFERRER_POLICY", "strict-origin-when-cross-origin")
+)
+
+// setPageHeaders adds the security headers to an HTML response.
+func setPageHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("X-Content-Type-Options", "nosniff")
+	for name, v := range map[string]string{
+		"Content-Security-Policy": contentSecurityPolicy,
+		"X-Frame-Options":         frameOptions,
+		"Referrer-Policy":         referrerPolicy,
+	} {
+		if v != "none" {
+			h.Set(name, v)
+		}
+	}
+}
+
+func renderPage(w http.ResponseWriter, page string, data interface{}) {
+	funcMap := template.FuncMap{
+		"add":           func(a, b int) int { return a + b },
+		"instanceName":  func() string { return instanceName },
+		"url":           pathTo,
+		"instanceIcon":  func() string { return instanceIcon },
+		"markdown":      renderMarkdown,
+		"periodOptions": func() map[string]string { return periodLabels },
+		"sortOptions":   func() map[string]string { return sortLabels },
+		"defaultSort":   func() string { return defaultSort },
+		"sub":           func(a, b int) int { return a - b },
+		"formatDate": func(t time.Time) string {
+			if t.Year() < 2000 {
+				return "—"
+			}
+			return t.Format("Jan 2, 2006")
+		},
+		"timeAgo": timeAgo,
+		"seq": func(n int) []int {
+			s := make([]int, n)
+			for i := range s {
+				s[i] = i + 1
+			}
+			return s
+		},
+	}
+	t, err := template.New("").Funcs(funcMap).ParseFS(templateFS, "templates/base.html", "templates/"+page+".html")
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), 500)
+		return
+	}
+	setPageHeaders(w)
+	if err := t.ExecuteTemplate(w, "base", data); err != nil {
+		log.Printf("template render error: %v", err)
+	}
+}
+
+// timeAgo renders t relative to now ("3 hours ago"), falling back to the
+// date after a month. Templates and ?relative=true JSON share it.
+func timeAgo(t time.Time) string {
+	if t.Year() < 2000 {
+		return "—"
+	}
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		m := int(d.Minutes())
+		if m == 1 {
+			return "1 minute ago"
+		}
+		return fmt.Sprintf("%d minutes ago", m)
+	case d < 24*time.Hour:
+		h := int(d.Hours())
+		if h == 1 {
+			return "1 hour ago"
+		}
+		return fmt.Sprintf("%d hours ago", h)
+	default:
+		days := int(d.Hours() / 24)
+		if days == 1 {
+			return "1 day ago"
+		}
+		if days < 30 {
+			return fmt.Sprintf("%d days ago", days)
+		}
+		return t.Format("Jan 2, 2006")
+	}
+}
+
+// --- Web Handlers ---
+
+// wantsJSON reports whether a web route should answer with JSON instead of HTML,
+// via ?format=json or an Accept header that prefers application/json.
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+func handleHome(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
 		return
 	}
-	q := strings.TrimSpace(r.URL.Query().Get("q"))
-	page := 1
-	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
-		page = p
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	safe := r.URL.Query().Get("safe") == "true"
+	period := r.URL.Query().Get("period")
+	if _, ok := projectPeriods[period]; !ok {
+		period = ""
+	}
+	sortBy := r.URL.Query().Get("sort")
+	if _, ok := projectSorts[sortBy]; !ok {
+		sortBy = defaultSort
+	}
+	filter := ProjectFilter{Search: q, SafeOnly: safe, Period: period, Sort: sortBy}
+	page := 1
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+		page = p
+	}
+
+	totalCount := getProjectCount(readDB, filter)
+	totalPages := int(math.Ceil(float64(totalCount) / float64(perPage)))
+	if totalPages < 1 {
+		totalPages = 1
+	}
+	if page > totalPages {
+		page = totalPages
+	}
+
+	offset := (page - 1) * perPage
+	projects, _ := getProjects(readDB, perPage, offset, filter)
+	if projects == nil {
+		projects = []Project{}
+	}
+	stats := getStats(readDB)
+
+	pag := Pagination{
+		Page:       page,
+		TotalPages: totalPages,
+		HasPrev:    page > 1,
+		HasNext:    page < totalPages,
+		PrevPage:   page - 1,
+		NextPage:   page + 1,
+		Query:      q,
+		Safe:       safe,
+		Period:     period,
+		Sort:       sortBy,
+	}
+
+	if wantsJSON(r) {
+		jsonResp(w, 200, map[string]interface{}{
+			"projects":   projects,
+			"pagination": pag,
+			"total":      totalCount,
+		})
+		return
+	}
+
+	renderPage(w, "home", map[string]interface{}{
+		"Projects":   projects,
+		"Stats":      stats,
+		"Query":      q,
+		"Pagination": pag,
+		"Offset":     offset,
+	})
+}
+
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	http.Redirect(w, r, pathTo("/?q="+url.QueryEscape(q)), http.StatusSeeOther)
+}
+
+func handleProject(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, "/project/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	p, err := getProject(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	recordView(r, id)
+	comments, _ := getComments(readDB, id, CommentPage{})
+	if comments == nil {
+		comments = []Comment{}
+	}
+	renderPage(w, "project", map[string]interface{}{
+		"Project":  p,
+		"Comments": comments,
+	})
+}
+
+func handleSkillMD(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Write(skillMD)
+}
+
+func handleSubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		renderPage(w, "submit", nil)
+		return
+	}
+	http.Error(w, "Use the API to submit projects: POST /api/v1/projects", http.StatusMethodNotAllowed)
+}
+
+// --- API Handlers ---
+
+// A registration may carry a client-generated retry_token. Repeating the
+// registration with the same name and token returns the original api_key
+// instead of a 409, so a client that lost the first response can recover.
+// Only a SHA-256 hash of the token is stored, and it is cleared once
+// retryTokenWindow has passed so the token can't stand in for the key later.
+const (
+	minRetryTokenLen = 16
+	maxRetryTokenLen = 200
+	retryTokenWindow = 10 * time.Minute
+)
+
+func hashRetryToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func handleAPIRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	ip := clientIP(r)
+	if ok, wait := checkIPRateLimit(ip, "register", ipRateLimits["register"]); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		jsonErr(w, 429, fmt.Sprintf("rate limit exceeded — max %d registrations per hour from one address", ipRateLimits["register"]))
+		return
+	}
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Challenge   string `json:"challenge"`
+		Nonce       string `json:"nonce"`
+		RetryToken  string `json:"retry_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	req.Description = strings.TrimSpace(req.Description)
+
+	if msg := validateAgentInput(req.Name, req.Description); msg != "" {
+		jsonErr(w, 400, msg)
+		return
+	}
+	if req.RetryToken != "" && (len(req.RetryToken) < minRetryTokenLen || len(req.RetryToken) > maxRetryTokenLen) {
+		jsonErr(w, 400, fmt.Sprintf("retry_token must be %d to %d characters", minRetryTokenLen, maxRetryTokenLen))
+		return
+	}
+	if powDifficulty > 0 {
+		if req.Challenge == "" {
+			jsonErr(w, 400, "challenge and nonce are required — GET /api/v1/agents/challenge first")
+			return
+		}
+		if msg := verifyPow(req.Challenge, req.Nonce); msg != "" {
+			jsonErr(w, 400, msg)
+			return
+		}
+	}
+
+	db.Exec("UPDATE agents SET retry_token_hash = '' WHERE retry_token_hash != '' AND created_at < ?",
+		time.Now().UTC().Add(-retryTokenWindow).Format(dbTimeFormat))
+	var existingName, existingKey, existingHash string
+	err := db.QueryRow("SELECT name, api_key, retry_token_hash FROM agents WHERE LOWER(name)=LOWER(?)", req.Name).
+		Scan(&existingName, &existingKey, &existingHash)
+	if err == nil {
+		if req.RetryToken != "" && existingHash != "" && hmac.Equal([]byte(hashRetryToken(req.RetryToken)), []byte(existingHash)) {
+			jsonResp(w, 200, map[string]string{
+				"api_key": existingKey,
+				"name":    html.UnescapeString(existingName),
+				"message": "You already registered this agent; here is its api_key again.",
+			})
+			return
+		}
+		jsonErrCode(w, 409, "name_taken", "agent name already taken")
+		return
+	}
+
+	key := generateAPIKey()
+	err = execWithRetry(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		retryHash := ""
+		if req.RetryToken != "" {
+			retryHash = hashRetryToken(req.RetryToken)
+		}
+		res, err := tx.Exec("INSERT INTO agents (name, api_key, description, retry_token_hash, created_at) VALUES (?, ?, ?, ?, ?)",
+			sanitize(req.Name), key, sanitize(req.Description), retryHash, dbNow())
+		if err != nil {
+			return err
+		}
+		id, _ := res.LastInsertId()
+		if err := audit(tx, int(id), "agent.register", fmt.Sprintf("agent:%d", id), map[string]string{"name": req.Name}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		writeErr(w, err, "failed to create agent")
+		return
+	}
+	recordIPAction(ip, "register")
+	jsonResp(w, 201, map[string]string{
+		"api_key": key,
+		"name":    req.Name,
+		"message": "Save your api_key! You need it for all authenticated requests.",
+	})
+}
+
+func handleAPIMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" {
+		handleAPIMeDelete(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	agent.APIKey = ""
+	db.QueryRow("SELECT COUNT(*) FROM projects WHERE submitted_by_id=? AND deleted_at IS NULL", agent.ID).Scan(&agent.ProjectsSubmitted)
+	db.QueryRow("SELECT COUNT(*) FROM votes WHERE agent_id=?", agent.ID).Scan(&agent.VotesCast)
+	jsonResp(w, 200, agent)
+}
+
+// handleAPIMeDelete closes the caller's account. The agent row and its key are
+// removed, its votes are withdrawn (project counters adjusted), its flags and
+// rate-limit history are dropped, and its comments stay but are attributed to
+// "[deleted]". Its projects are kept under "anonymous" by default, or hidden
+// with {"projects": "delete"}; a hidden project's URL stays reserved.
+func handleAPIMeDelete(w http.ResponseWriter, r *http.Request) {
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	var req struct {
+		Projects string `json:"projects"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
+			return
+		}
+	}
+	if req.Projects == "" {
+		req.Projects = "anonymize"
+	}
+	if req.Projects != "anonymize" && req.Projects != "delete" {
+		jsonErr(w, 400, "projects must be 'anonymize' or 'delete'")
+		return
+	}
+
+	type stmt struct {
+		query string
+		args  []interface{}
+	}
+	stmts := []stmt{
+		{`UPDATE projects SET
+			upvotes = upvotes - (SELECT COUNT(*) FROM votes v WHERE v.agent_id = ? AND v.project_id = projects.id AND v.vote_type = 'up'),
+			downvotes = downvotes - (SELECT COUNT(*) FROM votes v WHERE v.agent_id = ? AND v.project_id = projects.id AND v.vote_type = 'down')
+			WHERE id IN (SELECT project_id FROM votes WHERE agent_id = ?)`, []interface{}{agent.ID, agent.ID, agent.ID}},
+		{"DELETE FROM votes WHERE agent_id = ?", []interface{}{agent.ID}},
+		{"UPDATE comments SET agent_name = '[deleted]', agent_id = 0 WHERE agent_id = ?", []interface{}{agent.ID}},
+		{"DELETE FROM flags WHERE agent_id = ?", []interface{}{agent.ID}},
+		{"DELETE FROM url_suggestions WHERE agent_id = ?", []interface{}{agent.ID}},
+		{"DELETE FROM subscriptions WHERE agent_id = ?", []interface{}{agent.ID}},
+		{"DELETE FROM notifications WHERE agent_id = ?", []interface{}{agent.ID}},
+		{"DELETE FROM rate_limits WHERE agent_id = ?", []interface{}{agent.ID}},
+		{"DELETE FROM api_keys WHERE agent_id = ?", []interface{}{agent.ID}},
+		{"DELETE FROM agents WHERE id = ?", []interface{}{agent.ID}},
+	}
+	if req.Projects == "delete" {
+		stmts = append(stmts, stmt{"UPDATE projects SET deleted_at = ? WHERE submitted_by_id = ?", []interface{}{dbNow(), agent.ID}})
+	} else {
+		stmts = append(stmts, stmt{"UPDATE projects SET submitted_by = 'anonymous', submitted_by_id = 0 WHERE submitted_by_id = ?", []interface{}{agent.ID}})
+	}
+	err = execWithRetry(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, st := range stmts {
+			if _, err := tx.Exec(st.query, st.args...); err != nil {
+				return err
+			}
+		}
+		if err := audit(tx, agent.ID, "agent.delete", fmt.Sprintf("agent:%d", agent.ID), map[string]string{"name": agent.Name, "projects": req.Projects}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		writeErr(w, err, "failed to delete account")
+		return
+	}
+	invalidateAgentAuth(agent.ID)
+	forgetVotes(agent.ID)
+	invalidateSimilar()
+	w.WriteHeader(204)
+}
+
+const maxAPIKeys = 10
+
+// handleAPIKeys mints extra api keys for the caller (POST {"scope": "read"}
+// or "full", default read) and revokes them (DELETE {"api_key": "..."}).
+// A read key can be embedded in client-side tooling without letting it vote,
+// comment or submit. The registration key itself can't be revoked here.
+func handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	var req struct {
+		Scope  string `json:"scope"`
+		APIKey string `json:"api_key"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
+			return
+		}
+	}
+	if r.Method == "DELETE" {
+		var res sql.Result
+		err := execWithRetry(func() error {
+			var err error
+			res, err = db.Exec("DELETE FROM api_keys WHERE key = ? AND agent_id = ?", req.APIKey, agent.ID)
+			return err
+		})
+		if err != nil {
+			writeErr(w, err, "failed to revoke key")
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			jsonErr(w, 404, "key not found")
+			return
+		}
+		invalidateAgentAuth(agent.ID)
+		w.WriteHeader(204)
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = scopeRead
+	}
+	if req.Scope != scopeRead && req.Scope != scopeFull {
+		jsonErr(w, 400, "scope must be 'read' or 'full'")
+		return
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM api_keys WHERE agent_id = ?", agent.ID).Scan(&count)
+	if count >= maxAPIKeys {
+		jsonErr(w, 409, fmt.Sprintf("at most %d extra keys per agent — revoke one first", maxAPIKeys))
+		return
+	}
+	key := generateAPIKey()
+	err = execWithRetry(func() error {
+		_, err := db.Exec("INSERT INTO api_keys (key, agent_id, scope, created_at) VALUES (?, ?, ?, ?)", key, agent.ID, req.Scope, dbNow())
+		return err
+	})
+	if err != nil {
+		writeErr(w, err, "failed to create key")
+		return
+	}
+	jsonResp(w, 201, map[string]string{"api_key": key, "scope": req.Scope})
+}
+
+// handleAPIToken exchanges a long-lived api_key for a short-lived signed token.
+// Tokens cannot be exchanged for further tokens.
+func handleAPIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	if len(tokenSecret) == 0 {
+		jsonErr(w, 404, "tokens are not enabled on this server")
+		return
+	}
+	if strings.HasPrefix(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), tokenPrefix) {
+		jsonErr(w, 403, "use your api_key, not a token, to request a token")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	var req struct {
+		TTL int `json:"ttl"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
+			return
+		}
+	}
+	ttl := defaultTokenTTL
+	if req.TTL > 0 {
+		ttl = min(time.Duration(req.TTL)*time.Second, maxTokenTTL)
+	}
+	token, exp := signToken(agent, ttl)
+	jsonResp(w, 201, map[string]interface{}{
+		"token":      token,
+		"expires_at": exp,
+	})
+}
+
+func handleAPIMeUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	type usage struct {
+		Used      int `json:"used"`
+		Limit     int `json:"limit"`
+		Remaining int `json:"remaining"`
+	}
+	actions := make(map[string]usage)
+	for action, limit := range rateLimits {
+		used := countRecentActions(agent.ID, action)
+		remaining := limit - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		actions[action] = usage{Used: used, Limit: limit, Remaining: remaining}
+	}
+	jsonResp(w, 200, map[string]interface{}{
+		"window":  "1h",
+		"actions": actions,
+	})
+}
+
+// handleAPIMeLimits reports each rate-limited action's budget without
+// recording anything, so an agent can pace itself before acting. resets_at is
+// when the oldest counted action ages out and frees a slot.
+func handleAPIMeLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	type status struct {
+		Limit    int        `json:"limit"`
+		Used     int        `json:"used"`
+		ResetsAt *time.Time `json:"resets_at"`
+	}
+	limits := make(map[string]status)
+	for action, limit := range rateLimits {
+		used, resets := recentActionWindow(agent.ID, action)
+		st := status{Limit: limit, Used: used}
+		if !resets.IsZero() {
+			st.ResetsAt = &resets
+		}
+		limits[action] = st
+	}
+	jsonResp(w, 200, limits)
+}
+
+// handleAPIMeCommented lists the projects the caller has commented on, most
+// recently commented first (?limit=&offset=).
+func handleAPIMeCommented(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	limit, offset := pageParams(r, defaultPageSize)
+	rows, err := readDB.Query(`SELECT `+projectCols+` FROM projects
+		JOIN (SELECT project_id, MAX(created_at) AS last_comment FROM comments WHERE agent_id = ? GROUP BY project_id) c
+			ON c.project_id = projects.id
+		WHERE deleted_at IS NULL
+		ORDER BY c.last_comment DESC, projects.id DESC LIMIT ? OFFSET ?`,
+		agent.ID, limit, offset,
+	)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	defer rows.Close()
+	projects := []Project{}
+	for rows.Next() {
+		p, err := scanProject(readDB, rows)
+		if err != nil {
+			jsonErr(w, 500, "database error")
+			return
+		}
+		projects = append(projects, *p)
+	}
+	capListTags(projects)
+	jsonResp(w, 200, projectsResponse(r, projects))
+}
+
+func handleAPIMeHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	limit, offset := pageParams(r, defaultPageSize)
+	rows, err := readDB.Query(`
+		SELECT 'submission', id, name, '', 0, created_at FROM projects WHERE submitted_by_id = ?
+		UNION ALL
+		SELECT 'vote', v.project_id, p.name, v.vote_type, 0, v.created_at
+			FROM votes v JOIN projects p ON p.id = v.project_id WHERE v.agent_id = ?
+		UNION ALL
+		SELECT 'comment', c.project_id, p.name, '', c.id, c.created_at
+			FROM comments c JOIN projects p ON p.id = c.project_id WHERE c.agent_id = ?
+		ORDER BY 6 DESC LIMIT ? OFFSET ?`,
+		agent.ID, agent.ID, agent.ID, limit, offset,
+	)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	defer rows.Close()
+	items := []HistoryItem{}
+	for rows.Next() {
+		var h HistoryItem
+		var t string
+		if err := rows.Scan(&h.Type, &h.ProjectID, &h.ProjectName, &h.Vote, &h.CommentID, &t); err != nil {
+			jsonErr(w, 500, "database error")
+			return
+		}
+		h.ProjectName = html.UnescapeString(h.ProjectName)
+		h.CreatedAt = parseTime(t)
+		items = append(items, h)
+	}
+	jsonResp(w, 200, items)
+}
+
+// handleAPIMeProjectVotes lists votes on the caller's visible projects,
+// newest first, without saying who cast them.
+func handleAPIMeProjectVotes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	limit, offset := pageParams(r, defaultPageSize)
+	rows, err := readDB.Query(`SELECT v.project_id, p.name, v.vote_type, v.created_at
+		FROM votes v JOIN projects p ON p.id = v.project_id
+		WHERE p.submitted_by_id = ? AND p.deleted_at IS NULL AND v.agent_id != ?
+		ORDER BY v.created_at DESC, v.project_id DESC LIMIT ? OFFSET ?`,
+		agent.ID, agent.ID, limit, offset,
+	)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	defer rows.Close()
+	votes := []ProjectVote{}
+	for rows.Next() {
+		var v ProjectVote
+		var t string
+		if err := rows.Scan(&v.ProjectID, &v.ProjectName, &v.Vote, &t); err != nil {
+			jsonErr(w, 500, "database error")
+			return
+		}
+		v.ProjectName = html.UnescapeString(v.ProjectName)
+		v.CreatedAt = parseTime(t)
+		votes = append(votes, v)
+	}
+	jsonResp(w, 200, votes)
+}
+
+const maxAgentLookup = 50
+
+// handleAPIAgents returns public profiles for ?names=a,b,c in the order given.
+// Unknown names are skipped rather than failing the whole lookup.
+func handleAPIAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	var names []string
+	seen := map[string]bool{}
+	for _, n := range strings.Split(r.URL.Query().Get("names"), ",") {
+		n = sanitize(n)
+		if n == "" || seen[strings.ToLower(n)] {
+			continue
+		}
+		seen[strings.ToLower(n)] = true
+		names = append(names, n)
+	}
+	if len(names) == 0 {
+		jsonErr(w, 400, "names is required (comma-separated agent names)")
+		return
+	}
+	if len(names) > maxAgentLookup {
+		jsonErr(w, 400, fmt.Sprintf("at most %d names per request", maxAgentLookup))
+		return
+	}
+	agents, err := getAgentsByName(readDB, names)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	jsonResp(w, 200, agents)
+}
+
+// handleAPIRecentAgents lists the newest agents' public profiles, newest
+// first (?limit=&offset=). The system agent is left out.
+func handleAPIRecentAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	limit, offset := pageParams(r, defaultPageSize)
+	rows, err := readDB.Query("SELECT id, name, description, created_at FROM agents WHERE id != ? ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?",
+		systemAgentID, limit, offset)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	defer rows.Close()
+	agents := []Agent{}
+	for rows.Next() {
+		var a Agent
+		var t string
+		if err := rows.Scan(&a.ID, &a.Name, &a.Description, &t); err != nil {
+			jsonErr(w, 500, "database error")
+			return
+		}
+		a.CreatedAt = parseTime(t)
+		a.Name = html.UnescapeString(a.Name)
+		a.Description = html.UnescapeString(a.Description)
+		agents = append(agents, a)
+	}
+	jsonResp(w, 200, agents)
+}
+
+// handleAPIContributors lists agents who have submitted visible projects,
+// most submissions first (?limit=&offset=). The system agent is left out.
+func handleAPIContributors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	limit, offset := pageParams(r, defaultPageSize)
+	rows, err := readDB.Query(`
+		SELECT a.name, COUNT(*) AS n FROM projects p JOIN agents a ON a.id = p.submitted_by_id
+		WHERE p.deleted_at IS NULL AND a.id != ?
+		GROUP BY a.id ORDER BY n DESC, a.name LIMIT ? OFFSET ?`, systemAgentID, limit, offset)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	defer rows.Close()
+	type contributor struct {
+		Name              string `json:"name"`
+		ProjectsSubmitted int    `json:"projects_submitted"`
+	}
+	contributors := []contributor{}
+	for rows.Next() {
+		var c contributor
+		if err := rows.Scan(&c.Name, &c.ProjectsSubmitted); err != nil {
+			jsonErr(w, 500, "database error")
+			return
+		}
+		c.Name = html.UnescapeString(c.Name)
+		contributors = append(contributors, c)
+	}
+	jsonResp(w, 200, contributors)
+}
+
+// handleAPIAgentRoute serves /agents/{name}/... paths not claimed by a more
+// specific route (register, token, me).
+func handleAPIAgentRoute(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, apiVersions["v1"]+"/agents/")
+	parts := strings.Split(path, "/")
+	if len(parts) == 2 && parts[0] != "" && parts[1] == "comments" {
+		handleAPIAgentComments(w, r, parts[0])
+		return
+	}
+	jsonErr(w, 404, "not found")
+}
+
+// handleAPIAgentComments lists an agent's comments across projects, newest first (?limit=&offset=).
+func handleAPIAgentComments(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	var agentID int
+	if err := db.QueryRow("SELECT id FROM agents WHERE LOWER(name)=LOWER(?)", sanitize(name)).Scan(&agentID); err != nil {
+		jsonErr(w, 404, "agent not found")
+		return
+	}
+	limit, offset := pageParams(r, defaultPageSize)
+	comments, err := getCommentsWithProject(readDB, "c.agent_id = ?", []interface{}{agentID}, limit, offset)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	jsonResp(w, 200, comments)
+}
+
+func handleAPIProjects(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		filter := ProjectFilter{
+			Search:   strings.TrimSpace(r.URL.Query().Get("q")),
+			SafeOnly: r.URL.Query().Get("safe") == "true",
+			Period:   r.URL.Query().Get("period"),
+			Sort:     r.URL.Query().Get("sort"),
+		}
+		for _, b := range []struct {
+			param string
+			dst   **int
+		}{{"min_score", &filter.MinScore}, {"max_score", &filter.MaxScore}} {
+			if v := r.URL.Query().Get(b.param); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					jsonErr(w, 400, b.param+" must be an integer")
+					return
+				}
+				*b.dst = &n
+			}
+		}
+		if filter.MinScore != nil && filter.MaxScore != nil && *filter.MinScore > *filter.MaxScore {
+			jsonErr(w, 400, "min_score must not be greater than max_score")
+			return
+		}
+		if msg := parseTagFilter(r.URL.Query(), &filter); msg != "" {
+			jsonErr(w, 400, msg)
+			return
+		}
+		limit, offset := pageParams(r, defaultPageSize)
+		projects, err := getProjects(readDB, limit, offset, filter)
+		if err != nil {
+			jsonErr(w, 500, "database error")
+			return
+		}
+		if projects == nil {
+			projects = []Project{}
+		}
+		if n, err := strconv.Atoi(r.URL.Query().Get("preview_comments")); err == nil && n > 0 {
+			ids := make([]int, len(projects))
+			for i, p := range projects {
+				ids[i] = p.ID
+			}
+			recent, err := getRecentComments(readDB, ids, min(n, maxPreviewComments))
+			if err != nil {
+				jsonErr(w, 500, "database error")
+				return
+			}
+			for i := range projects {
+				projects[i].RecentComments = recent[projects[i].ID]
+			}
+		}
+		jsonResp(w, 200, projectsResponse(r, projects))
+
+	case "POST":
+		agent, err := authAgent(r)
+		anonymous := false
+		if err != nil {
+			if !allowAnonSubmit || r.Header.Get("Authorization") != "" {
+				authErr(w, err)
+				return
+			}
+			anonymous = true
+			agent = &Agent{Name: "anonymous"}
+		}
+		ip := clientIP(r)
+		if anonymous {
+			if ok, wait := checkIPRateLimit(ip, "submit", ipRateLimits["submit"]); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				jsonErr(w, 429, fmt.Sprintf("rate limit exceeded — max %d anonymous submissions per hour from one address", ipRateLimits["submit"]))
+				return
+			}
+		} else if !checkRateLimit(agent.ID, "submit", rateLimits["submit"]) {
+			jsonErr(w, 429, fmt.Sprintf("rate limit exceeded — max %d project submissions per hour", rateLimits["submit"]))
+			return
+		}
+		if !anonymous && maxProjectsPerAgent > 0 {
+			var submitted int
+			db.QueryRow("SELECT COUNT(*) FROM projects WHERE submitted_by_id=?", agent.ID).Scan(&submitted)
+			if submitted >= maxProjectsPerAgent {
+				jsonErrCode(w, 403, "project_cap_reached", fmt.Sprintf("project limit reached — you have submitted %d of the %d projects allowed per agent", submitted, maxProjectsPerAgent))
+				return
+			}
+		}
+		var req struct {
+			Name        string   `json:"name"`
+			URL         string   `json:"url"`
+			Description string   `json:"description"`
+			NSFW        bool     `json:"nsfw"`
+			Tags        []string `json:"tags"`
+			Source      string   `json:"source"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		req.URL = strings.TrimSpace(req.URL)
+		req.Description = strings.TrimSpace(req.Description)
+		if msg, status := validateProjectInput(req.Name, req.URL, req.Description); msg != "" {
+			jsonErr(w, status, msg)
+			return
+		}
+		req.URL = normalizeURL(req.URL)
+		tags, msg := validateTags(req.Tags)
+		if msg != "" {
+			jsonErr(w, 400, msg)
+			return
+		}
+		source := sanitize(req.Source)
+		if len(source) > maxSourceLen {
+			jsonErr(w, 400, fmt.Sprintf("source must be %d characters or less", maxSourceLen))
+			return
+		}
+		if source == "" {
+			source = "api"
+		}
+		var existingID int
+		err = db.QueryRow("SELECT id FROM projects WHERE LOWER(url)=LOWER(?)", req.URL).Scan(&existingID)
+		if err == nil {
+			// ?if_not_exists=true makes resubmitting a listed URL a no-op
+			// that returns the existing project, for idempotent imports.
+			if r.URL.Query().Get("if_not_exists") == "true" {
+				if p, err := getProject(existingID); err == nil {
+					jsonResp(w, 200, p)
+					return
+				}
+			}
+			conflictWithProject(w, "duplicate_url", fmt.Sprintf("project with this URL already exists (id: %d)", existingID), existingID)
+			return
+		}
+		if uniqueNames {
+			err = db.QueryRow("SELECT id FROM projects WHERE LOWER(name)=LOWER(?)", sanitize(req.Name)).Scan(&existingID)
+			if err == nil {
+				conflictWithProject(w, "duplicate_name", fmt.Sprintf("project with this name already exists (id: %d)", existingID), existingID)
+				return
+			}
+		}
+		var id int64
+		var token interface{} // NULL unless the project is held for approval
+		var pendingSince interface{}
+		if submissionWebhookURL != "" {
+			b := make([]byte, 20)
+			rand.Read(b)
+			token, pendingSince = hex.EncodeToString(b), dbNow()
+		}
+		err = execWithRetry(func() error {
+			tx, err := db.Begin()
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			res, err := tx.Exec(
+				"INSERT INTO projects (name, url, description, submitted_by, submitted_by_id, nsfw, source, created_at, deleted_at, approval_token) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				sanitize(req.Name), req.URL, sanitize(req.Description), agent.Name, agent.ID, req.NSFW, source, dbNow(), pendingSince, token,
+			)
+			if err != nil {
+				return err
+			}
+			id, _ = res.LastInsertId()
+			if err := setProjectTags(tx, int(id), tags); err != nil {
+				return err
+			}
+			if err := audit(tx, agent.ID, "project.create", projectTarget(int(id)), map[string]string{"name": req.Name, "url": req.URL}); err != nil {
+				return err
+			}
+			return tx.Commit()
+		})
+		if err != nil {
+			writeErr(w, err, "failed to create project")
+			return
+		}
+		if anonymous {
+			recordIPAction(ip, "submit")
+		} else {
+			recordAction(agent.ID, "submit")
+		}
+		if token != nil {
+			go deliverSubmission(int(id))
+			jsonResp(w, 202, map[string]interface{}{
+				"id":      id,
+				"status":  "pending",
+				"message": "Your project is awaiting moderation and will appear once approved.",
+			})
+			return
+		}
+		invalidateSimilar()
+		p, _ := getProject(int(id))
+		jsonResp(w, 201, p)
+
+	default:
+		jsonErr(w, 405, "method not allowed")
+	}
+}
+
+const maxCompareProjects = 5
+
+const maxCommentCountIDs = 100
+
+// handleAPICommentCounts maps each of ?ids=1,2,... (up to 100) to its comment
+// count in one query, for clients refreshing counts on projects they already
+// have. Unknown and deleted ids are left out.
+func handleAPICommentCounts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	var ids []interface{}
+	seen := map[int]bool{}
+	for _, v := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || id <= 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		jsonErr(w, 400, "ids is required")
+		return
+	}
+	if len(ids) > maxCommentCountIDs {
+		jsonErr(w, 400, fmt.Sprintf("at most %d ids per request", maxCommentCountIDs))
+		return
+	}
+	rows, err := readDB.Query(`SELECT p.id, COUNT(c.id) FROM projects p
+		LEFT JOIN comments c ON c.project_id = p.id
+		WHERE p.id IN (`+strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")+`) AND p.deleted_at IS NULL
+		GROUP BY p.id`, ids...)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var id, n int
+		if err := rows.Scan(&id, &n); err != nil {
+			jsonErr(w, 500, "database error")
+			return
+		}
+		counts[strconv.Itoa(id)] = n
+	}
+	jsonResp(w, 200, counts)
+}
+
+// handleAPICompareProjects lines up ?ids=1,2,... (2 to 5 projects) with
+// derived metrics for side-by-side evaluation. Unknown ids are dropped, and
+// fewer than two that remain is an error. leaders names the project ahead on
+// each metric; ties go to the first listed.
+func handleAPICompareProjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	var ids []int
+	seen := map[int]bool{}
+	for _, v := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || id <= 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) > maxCompareProjects {
+		jsonErr(w, 400, fmt.Sprintf("at most %d ids can be compared", maxCompareProjects))
+		return
+	}
+	type comparison struct {
+		*Project
+		VoteRatio *float64 `json:"vote_ratio"`
+		AgeDays   float64  `json:"age_days"`
+	}
+	projects := []comparison{}
+	for _, id := range ids {
+		p, err := getProject(id)
+		if err != nil {
+			continue
+		}
+		c := comparison{Project: p, AgeDays: math.Round(time.Since(p.CreatedAt).Hours()/24*10) / 10}
+		if total := p.Upvotes + p.Downvotes; total > 0 {
+			ratio := math.Round(float64(p.Upvotes)/float64(total)*1000) / 1000
+			c.VoteRatio = &ratio
+		}
+		projects = append(projects, c)
+	}
+	if len(projects) < 2 {
+		jsonErr(w, 400, "ids must name at least 2 existing projects")
+		return
+	}
+	leaders := map[string]int{}
+	best := map[string]float64{}
+	for _, c := range projects {
+		metrics := map[string]float64{
+			"score":         c.Score,
+			"comment_count": float64(c.CommentCount),
+			"views":         float64(c.Views),
+		}
+		if c.VoteRatio != nil {
+			metrics["vote_ratio"] = *c.VoteRatio
+		}
+		for m, v := range metrics {
+			if _, ok := leaders[m]; !ok || v > best[m] {
+				leaders[m], best[m] = c.ID, v
+			}
+		}
+	}
+	jsonResp(w, 200, map[string]interface{}{
+		"projects": projects,
+		"leaders":  leaders,
+	})
+}
+
+// handleAPIModeration settles a project held for approval: POST
+// {"token": "...", "decision": "approve"|"reject"}. The token is the one sent
+// to SUBMISSION_WEBHOOK_URL; an admin may moderate without it. Approving
+// publishes the project; rejecting leaves it hidden, its URL still reserved
+// like a deleted project's.
+func handleAPIModeration(w http.ResponseWriter, r *http.Request, projectID int) {
+	if r.Method != "POST" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	var req struct {
+		Token    string `json:"token"`
+		Decision string `json:"decision"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
+		return
+	}
+	if req.Decision != "approve" && req.Decision != "reject" {
+		jsonErr(w, 400, "decision must be 'approve' or 'reject'")
+		return
+	}
+	var token string
+	if err := db.QueryRow("SELECT approval_token FROM projects WHERE id=? AND approval_token IS NOT NULL", projectID).Scan(&token); err != nil {
+		jsonErr(w, 404, "no pending project with this id")
+		return
+	}
+	if !isAdmin(r) && !hmac.Equal([]byte(req.Token), []byte(token)) {
+		jsonErr(w, 403, "invalid moderation token")
+		return
+	}
+	update := "UPDATE projects SET approval_token = NULL WHERE id = ?"
+	if req.Decision == "approve" {
+		update = "UPDATE projects SET approval_token = NULL, deleted_at = NULL WHERE id = ?"
+	}
+	err := execWithRetry(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(update, projectID); err != nil {
+			return err
+		}
+		if err := audit(tx, 0, "project."+req.Decision, projectTarget(projectID), nil); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		writeErr(w, err, "failed to moderate project")
+		return
+	}
+	if req.Decision == "reject" {
+		jsonResp(w, 200, map[string]interface{}{"id": projectID, "status": "rejected"})
+		return
+	}
+	invalidateSimilar()
+	p, _ := getProject(projectID)
+	jsonResp(w, 200, p)
+}
+
+// handleAPIProjectByURL returns the project listed at ?url=, matched the way
+// submissions are de-duplicated, or 404.
+func handleAPIProjectByURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	u := strings.TrimSpace(r.URL.Query().Get("url"))
+	if msg := validateURL(u); msg != "" {
+		jsonErr(w, 400, msg)
+		return
+	}
+	var id int
+	if err := db.QueryRow("SELECT id FROM projects WHERE LOWER(url)=LOWER(?) AND deleted_at IS NULL", normalizeURL(u)).Scan(&id); err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	p, err := getProject(id)
+	if err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	jsonResp(w, 200, p)
+}
+
+// handleAPIProjectExists reports whether a URL has been submitted, applying
+// the same normalization and matching as the submit path, so clients can
+// check before posting instead of handling a 409. A URL reserved by a removed
+// project exists but has no project to show.
+func handleAPIProjectExists(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	u := strings.TrimSpace(r.URL.Query().Get("url"))
+	if msg := validateURL(u); msg != "" {
+		jsonErr(w, 400, msg)
+		return
+	}
+	var id int
+	if err := db.QueryRow("SELECT id FROM projects WHERE LOWER(url)=LOWER(?)", normalizeURL(u)).Scan(&id); err != nil {
+		jsonResp(w, 200, map[string]bool{"exists": false})
+		return
+	}
+	resp := map[string]interface{}{"exists": true}
+	if p, err := getProject(id); err == nil {
+		resp["project"] = p
+	}
+	jsonResp(w, 200, resp)
+}
+
+// handleAPIActiveProjects lists projects by their most recent comment within the last few days.
+func handleAPIActiveProjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	days := 7
+	if d, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && d > 0 && d <= 7 {
+		days = d
+	}
+	limit, offset := pageParams(r, 20)
+	rows, err := readDB.Query(
+		`SELECT project_id, MAX(created_at) AS last_comment_at FROM comments
+		WHERE created_at > datetime('now', ?)
+		GROUP BY project_id ORDER BY last_comment_at DESC LIMIT ? OFFSET ?`,
+		fmt.Sprintf("-%d days", days), limit, offset,
+	)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	type activity struct {
+		id   int
+		last string
+	}
+	var found []activity
+	for rows.Next() {
+		var a activity
+		if rows.Scan(&a.id, &a.last) == nil {
+			found = append(found, a)
+		}
+	}
+	rows.Close()
+
+	type activeProject struct {
+		*Project
+		LastCommentAt time.Time `json:"last_comment_at"`
+	}
+	projects := []activeProject{}
+	n := descLimit(r)
+	for _, a := range found {
+		p, err := scanProject(readDB, readDB.QueryRow("SELECT "+projectCols+" FROM projects WHERE id=? AND deleted_at IS NULL", a.id))
+		if err != nil {
+			continue
+		}
+		if n > 0 {
+			p.Description = truncateText(p.Description, n)
+		}
+		projects = append(projects, activeProject{p, parseTime(a.last)})
+	}
+	jsonResp(w, 200, projects)
+}
+
+// conflictWithProject writes a 409 that carries the existing project, so clients
+// can vote or comment on it instead of resubmitting.
+func conflictWithProject(w http.ResponseWriter, code, msg string, existingID int) {
+	existing, _ := getProject(existingID)
+	jsonResp(w, 409, map[string]interface{}{
+		"error":    msg,
+		"code":     code,
+		"existing": existing,
+	})
+}
+
+func handleAPIProjectRoute(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, apiVersions["v1"]+"/projects/")
+	parts := strings.Split(path, "/")
+
+	if parts[0] == "" {
+		jsonErr(w, 400, "missing project id")
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		jsonErr(w, 400, "invalid project id")
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method == "PATCH" {
+			handleAPIProjectUpdate(w, r, id)
+			return
+		}
+		if r.Method != "GET" {
+			jsonErr(w, 405, "method not allowed")
+			return
+		}
+		p, err := getProject(id)
+		if err != nil {
+			jsonErr(w, 404, "project not found")
+			return
+		}
+		recordView(r, id)
+		switch r.URL.Query().Get("include") {
+		case "":
+			jsonResp(w, 200, p)
+		case "comments":
+			// The first page of comments, nested so a client can render the
+			// project page in one request, as handleProject does for HTML.
+			comments, err := getComments(readDB, id, CommentPage{Limit: defaultPageSize})
+			if err != nil {
+				jsonErr(w, 500, "database error")
+				return
+			}
+			if comments == nil {
+				comments = []Comment{}
+			}
+			jsonResp(w, 200, struct {
+				*Project
+				Comments []Comment `json:"comments"`
+			}{p, comments})
+		default:
+			jsonErr(w, 400, "include must be 'comments'")
+		}
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "vote" {
+		handleAPIVote(w, r, id)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "export" {
+		handleAPIProjectExport(w, r, id)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "moderation" {
+		handleAPIModeration(w, r, id)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "similar" {
+		handleAPISimilarProjects(w, r, id)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "voters" {
+		handleAPIVoters(w, r, id)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "comments" {
+		handleAPIComments(w, r, id)
+		return
+	}
+
+	if len(parts) == 4 && parts[1] == "comments" && parts[3] == "pin" {
+		commentID, err := strconv.Atoi(parts[2])
+		if err != nil {
+			jsonErr(w, 400, "invalid comment id")
+			return
+		}
+		handleAPICommentPin(w, r, id, commentID)
+		return
+	}
+
+	if len(parts) == 3 && parts[1] == "comments" && parts[2] == "lock" {
+		handleAPICommentsLock(w, r, id)
+		return
+	}
+
+	if len(parts) == 3 && parts[1] == "comments" {
+		commentID, err := strconv.Atoi(parts[2])
+		if err != nil {
+			jsonErr(w, 400, "invalid comment id")
+			return
+		}
+		handleAPICommentEdit(w, r, id, commentID)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "tags" {
+		handleAPIProjectTags(w, r, id)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "flag" {
+		handleAPIFlag(w, r, id)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "subscribe" {
+		handleAPISubscribe(w, r, id)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "suggest-url" {
+		handleAPISuggestURL(w, r, id)
+		return
+	}
+
+	jsonErr(w, 404, "not found")
+}
+
+// isAdmin reports whether r carries the ADMIN_KEY bearer token, for endpoints
+// that admins may use alongside agents.
+func isAdmin(r *http.Request) bool {
+	adminKey := os.Getenv("ADMIN_KEY")
+	return adminKey != "" && strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ") == adminKey
+}
+
+// requireAdmin checks the ADMIN_KEY bearer token, writing a 403 and returning false if it doesn't match.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	adminKey := os.Getenv("ADMIN_KEY")
+	if adminKey == "" {
+		jsonErr(w, 403, "admin endpoint not configured")
+		return false
+	}
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if auth != adminKey {
+		jsonErr(w, 403, "forbidden")
+		return false
+	}
+	return true
+}
+
+func handleAPIProjectUpdate(w http.ResponseWriter, r *http.Request, projectID int) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req struct {
+		Description    *string `json:"description,omitempty"`
+		Name           *string `json:"name,omitempty"`
+		URL            *string `json:"url,omitempty"`
+		NSFW           *bool   `json:"nsfw,omitempty"`
+		CommentsLocked *bool   `json:"comments_locked,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
+		return
+	}
+	if _, err := getProject(projectID); err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	if req.URL != nil {
+		// Held to the same rules as a submitted or suggested URL.
+		u := strings.TrimSpace(*req.URL)
+		if msg := validateURL(u); msg != "" {
+			jsonErr(w, 400, msg)
+			return
+		}
+		u = normalizeURL(u)
+		var existingID int
+		if db.QueryRow("SELECT id FROM projects WHERE LOWER(url)=LOWER(?) AND id != ?", u, projectID).Scan(&existingID) == nil {
+			conflictWithProject(w, "duplicate_url", fmt.Sprintf("another project already uses this URL (id: %d)", existingID), existingID)
+			return
+		}
+		req.URL = &u
+	}
+	type stmt struct {
+		query string
+		args  []interface{}
+	}
+	var stmts []stmt
+	if req.Description != nil {
+		stmts = append(stmts, stmt{"UPDATE projects SET description = ? WHERE id = ?", []interface{}{*req.Description, projectID}})
+	}
+	if req.Name != nil {
+		stmts = append(stmts, stmt{"UPDATE projects SET name = ? WHERE id = ?", []interface{}{*req.Name, projectID}})
+	}
+	if req.URL != nil {
+		// Setting the URL directly settles any pending suggestions.
+		stmts = append(stmts,
+			stmt{"UPDATE projects SET url = ?, link_status = 'unknown', link_checked_at = NULL WHERE id = ?", []interface{}{*req.URL, projectID}},
+			stmt{"DELETE FROM url_suggestions WHERE project_id = ?", []interface{}{projectID}})
+	}
+	if req.NSFW != nil {
+		stmts = append(stmts, stmt{"UPDATE projects SET nsfw = ? WHERE id = ?", []interface{}{*req.NSFW, projectID}})
+	}
+	if req.CommentsLocked != nil {
+		stmts = append(stmts, stmt{"UPDATE projects SET comments_locked = ? WHERE id = ?", []interface{}{*req.CommentsLocked, projectID}})
+	}
+	err := execWithRetry(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, st := range stmts {
+			if _, err := tx.Exec(st.query, st.args...); err != nil {
+				return err
+			}
+		}
+		// Admin edits have no agent behind them; they're logged as agent 0.
+		if err := audit(tx, 0, "project.edit", projectTarget(projectID), req); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		writeErr(w, err, "failed to update project")
+		return
+	}
+	invalidateSimilar()
+	p, _ := getProject(projectID)
+	jsonResp(w, 200, p)
+}
+
+func handleAPIProjectTags(w http.ResponseWriter, r *http.Request, projectID int) {
+	if r.Method != "PUT" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	var submitterID int
+	if err := db.QueryRow("SELECT submitted_by_id FROM projects WHERE id=? AND deleted_at IS NULL", projectID).Scan(&submitterID); err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	if submitterID != agent.ID {
+		jsonErr(w, 403, "only the submitter can change a project's tags")
+		return
+	}
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
+		return
+	}
+	tags, msg := validateTags(req.Tags)
+	if msg != "" {
+		jsonErr(w, 400, msg)
+		return
+	}
+	err = execWithRetry(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := setProjectTags(tx, projectID, tags); err != nil {
+			return err
+		}
+		if err := audit(tx, agent.ID, "project.tags", projectTarget(projectID), map[string][]string{"tags": tags}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		writeErr(w, err, "failed to update tags")
+		return
+	}
+	jsonResp(w, 200, map[string]interface{}{"tags": getProjectTags(db, projectID)})
+}
+
+func handleAPIFlag(w http.ResponseWriter, r *http.Request, projectID int) {
+	if r.Method != "POST" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	if !checkRateLimit(agent.ID, "flag", rateLimits["flag"]) {
+		jsonErr(w, 429, fmt.Sprintf("rate limit exceeded — max %d flags per hour", rateLimits["flag"]))
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !flagReasons[req.Reason] {
+		jsonErr(w, 400, "reason must be one of 'spam', 'broken', 'inappropriate', 'other'")
+		return
+	}
+	if _, err := getProject(projectID); err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	var flagged int64
+	err = execWithRetry(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		res, err := tx.Exec("INSERT OR IGNORE INTO flags (agent_id, project_id, reason, created_at) VALUES (?, ?, ?, ?)", agent.ID, projectID, req.Reason, dbNow())
+		if err != nil {
+			return err
+		}
+		if flagged, _ = res.RowsAffected(); flagged == 0 {
+			return nil
+		}
+		if err := audit(tx, agent.ID, "project.flag", projectTarget(projectID), map[string]string{"reason": req.Reason}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		writeErr(w, err, "failed to flag project")
+		return
+	}
+	if flagged == 0 {
+		jsonErrCode(w, 409, "already_flagged", "you have already flagged this project")
+		return
+	}
+	recordAction(agent.ID, "flag")
+
+	if req.Reason == "broken" {
+		var broken int
+		db.QueryRow("SELECT COUNT(*) FROM flags WHERE project_id=? AND reason='broken'", projectID).Scan(&broken)
+		// Claiming link_checked_at queues the check once, however many
+		// flags follow; a URL change clears it to allow another.
+		if broken >= brokenFlagThreshold {
+			res, err := db.Exec("UPDATE projects SET link_checked_at = ? WHERE id = ? AND link_checked_at IS NULL", dbNow(), projectID)
+			if err == nil {
+				if n, _ := res.RowsAffected(); n == 1 {
+					queueLinkCheck(projectID)
+				}
+			}
+		}
+	}
+	jsonResp(w, 201, map[string]string{"message": "thanks, a moderator will take a look"})
+}
+
+// handleAPISuggestURL lets agents propose a new URL for a project that moved.
+// GET lists pending suggestions; POST records the caller's (one per agent,
+// replacing any earlier one). Once urlSuggestionThreshold agents agree on the
+// same URL it awaits the submitter or an admin, who applies it with PUT or
+// discards it with DELETE. Admins can also set the URL with PATCH.
+func handleAPISuggestURL(w http.ResponseWriter, r *http.Request, projectID int) {
+	if r.Method == "PUT" || r.Method == "DELETE" {
+		handleAPIReviewURL(w, r, projectID)
+		return
+	}
+	if r.Method == "GET" {
+		if _, err := getProject(projectID); err != nil {
+			jsonErr(w, 404, "project not found")
+			return
+		}
+		rows, err := db.Query("SELECT url, COUNT(*) FROM url_suggestions WHERE project_id=? GROUP BY url ORDER BY 2 DESC, url", projectID)
+		if err != nil {
+			jsonErr(w, 500, "database error")
+			return
+		}
+		defer rows.Close()
+		type suggestion struct {
+			URL              string `json:"url"`
+			Count            int    `json:"count"`
+			AwaitingApproval bool   `json:"awaiting_approval"`
+		}
+		out := []suggestion{}
+		for rows.Next() {
+			var sg suggestion
+			if rows.Scan(&sg.URL, &sg.Count) == nil {
+				sg.AwaitingApproval = sg.Count >= urlSuggestionThreshold
+				out = append(out, sg)
+			}
+		}
+		jsonResp(w, 200, map[string]interface{}{"suggestions": out, "needed": urlSuggestionThreshold})
+		return
+	}
+	if r.Method != "POST" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	if !checkRateLimit(agent.ID, "suggest", rateLimits["suggest"]) {
+		jsonErr(w, 429, fmt.Sprintf("rate limit exceeded — max %d URL suggestions per hour", rateLimits["suggest"]))
+		return
+	}
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
+		return
+	}
+	newURL := strings.TrimSpace(req.URL)
+	if msg := validateURL(newURL); msg != "" {
+		jsonErr(w, 400, msg)
+		return
+	}
+	newURL = normalizeURL(newURL)
+	p, err := getProject(projectID)
+	if err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	if strings.EqualFold(normalizeURL(p.URL), newURL) {
+		jsonErr(w, 400, "that is already the project's url")
+		return
+	}
+	var existingID int
+	if db.QueryRow("SELECT id FROM projects WHERE LOWER(url)=LOWER(?) AND id != ?", newURL, projectID).Scan(&existingID) == nil {
+		conflictWithProject(w, "duplicate_url", fmt.Sprintf("another project already uses this URL (id: %d)", existingID), existingID)
+		return
+	}
+
+	var agreeing int
+	err = execWithRetry(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec("INSERT OR REPLACE INTO url_suggestions (agent_id, project_id, url, created_at) VALUES (?, ?, ?, ?)",
+			agent.ID, projectID, newURL, dbNow()); err != nil {
+			return err
+		}
+		if err := tx.QueryRow("SELECT COUNT(*) FROM url_suggestions WHERE project_id=? AND url=?", projectID, newURL).Scan(&agreeing); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		writeErr(w, err, "failed to record suggestion")
+		return
+	}
+	recordAction(agent.ID, "suggest")
+	jsonResp(w, 201, map[string]interface{}{
+		"agreeing":          agreeing,
+		"needed":            urlSuggestionThreshold,
+		"awaiting_approval": agreeing >= urlSuggestionThreshold,
+		"project":           p,
+	})
+}
+
+// handleAPIReviewURL lets the submitter or an admin apply (PUT) or discard
+// (DELETE) a suggested URL given as {"url": "..."}. Only a URL enough agents
+// agreed on can be applied; the change is audited.
+func handleAPIReviewURL(w http.ResponseWriter, r *http.Request, projectID int) {
+	var submitterID int
+	var oldURL string
+	if err := db.QueryRow("SELECT submitted_by_id, url FROM projects WHERE id=? AND deleted_at IS NULL", projectID).Scan(&submitterID, &oldURL); err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	actorID := 0
+	if !isAdmin(r) {
+		agent, err := authAgent(r)
+		if err != nil {
+			authErr(w, err)
+			return
+		}
+		if submitterID == 0 || submitterID != agent.ID {
+			jsonErr(w, 403, "only the project's submitter can review suggested URLs")
+			return
+		}
+		actorID = agent.ID
+	}
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
+		return
+	}
+	newURL := normalizeURL(strings.TrimSpace(req.URL))
+	var agreeing int
+	db.QueryRow("SELECT COUNT(*) FROM url_suggestions WHERE project_id=? AND url=?", projectID, newURL).Scan(&agreeing)
+	if agreeing == 0 {
+		jsonErr(w, 404, "no such suggestion")
+		return
+	}
+	apply := r.Method == "PUT"
+	if apply && agreeing < urlSuggestionThreshold {
+		jsonErr(w, 409, fmt.Sprintf("only %d of the %d agents needed agree on this URL", agreeing, urlSuggestionThreshold))
+		return
+	}
+	var existingID int
+	if apply && db.QueryRow("SELECT id FROM projects WHERE LOWER(url)=LOWER(?) AND id != ?", newURL, projectID).Scan(&existingID) == nil {
+		conflictWithProject(w, "duplicate_url", fmt.Sprintf("another project already uses this URL (id: %d)", existingID), existingID)
+		return
+	}
+	err := execWithRetry(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		action, cleanup := "project.url_reject", "DELETE FROM url_suggestions WHERE project_id = ? AND url = ?"
+		args := []interface{}{projectID, newURL}
+		if apply {
+			if _, err := tx.Exec("UPDATE projects SET url = ?, link_status = 'unknown', link_checked_at = NULL WHERE id = ?", newURL, projectID); err != nil {
+				return err
+			}
+			action, cleanup, args = "project.url", "DELETE FROM url_suggestions WHERE project_id = ?", args[:1]
+		}
+		if _, err := tx.Exec(cleanup, args...); err != nil {
+			return err
+		}
+		if err := audit(tx, actorID, action, projectTarget(projectID), map[string]interface{}{"from": oldURL, "to": newURL, "agreeing": agreeing}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		writeErr(w, err, "failed to review suggestion")
+		return
+	}
+	if apply {
+		log.Printf("url suggestion: project %d moved to %s after %d agreeing agents", projectID, newURL, agreeing)
+	}
+	p, _ := getProject(projectID)
+	jsonResp(w, 200, p)
+}
+
+// applyVote records agentID's vote on projectID within tx, keeping the project's
+// counters in sync. The opposite vote switches it. Repeating the same vote
+// removes it when toggle is set (POST semantics) and is a no-op otherwise (PUT).
+// It returns what it did: "created", "switched", "removed" or "unchanged".
+func applyVote(tx *sql.Tx, agentID, projectID int, vote string, toggle bool) (string, error) {
+	var oldVote string
+	err := tx.QueryRow("SELECT vote_type FROM votes WHERE agent_id=? AND project_id=?", agentID, projectID).Scan(&oldVote)
+
+	if err == sql.ErrNoRows {
+		if _, err := tx.Exec("INSERT INTO votes (agent_id, project_id, vote_type, created_at) VALUES (?,?,?,?)", agentID, projectID, vote, dbNow()); err != nil {
+			return "", err
+		}
+		counter := "UPDATE projects SET downvotes = downvotes + 1 WHERE id=?"
+		if vote == "up" {
+			counter = "UPDATE projects SET upvotes = upvotes + 1 WHERE id=?"
+		}
+		if _, err := tx.Exec(counter, projectID); err != nil {
+			return "", err
+		}
+		return "created", audit(tx, agentID, "vote.create", projectTarget(projectID), map[string]string{"vote": vote})
+	} else if err != nil {
+		return "", err
+	}
+	if oldVote == vote {
+		if toggle {
+			return "removed", removeVote(tx, agentID, projectID, oldVote)
+		}
+		return "unchanged", nil
+	}
+	if _, err := tx.Exec("UPDATE votes SET vote_type=?, updated_at=? WHERE agent_id=? AND project_id=?", vote, dbNow(), agentID, projectID); err != nil {
+		return "", err
+	}
+	counter := "UPDATE projects SET upvotes = upvotes - 1, downvotes = downvotes + 1 WHERE id=?"
+	if vote == "up" {
+		counter = "UPDATE projects SET upvotes = upvotes + 1, downvotes = downvotes - 1 WHERE id=?"
+	}
+	if _, err := tx.Exec(counter, projectID); err != nil {
+		return "", err
+	}
+	return "switched", audit(tx, agentID, "vote.switch", projectTarget(projectID), map[string]string{"from": oldVote, "to": vote})
+}
+
+// removeVote deletes an existing vote of type oldVote and decrements the matching counter.
+func removeVote(tx *sql.Tx, agentID, projectID int, oldVote string) error {
+	if _, err := tx.Exec("DELETE FROM votes WHERE agent_id=? AND project_id=?", agentID, projectID); err != nil {
+		return err
+	}
+	counter := "UPDATE projects SET downvotes = downvotes - 1 WHERE id=?"
+	if oldVote == "up" {
+		counter = "UPDATE projects SET upvotes = upvotes - 1 WHERE id=?"
+	}
+	if _, err := tx.Exec(counter, projectID); err != nil {
+		return err
+	}
+	return audit(tx, agentID, "vote.remove", projectTarget(projectID), map[string]string{"vote": oldVote})
+}
+
+// A POST repeating an agent's last vote on a project within this window is
+// taken as a retry (a double click, a client resend) rather than a toggle.
+var voteDuplicateWindow = envDuration("VOTE_DUPLICATE_WINDOW", 2*time.Second)
+
+// recentVotes remembers each agent's latest vote per project ("agentID|projectID")
+// for voteDuplicateWindow.
+var recentVotes = struct {
+	sync.Mutex
+	m map[string]recentVote
+}{m: map[string]recentVote{}}
+
+type recentVote struct {
+	vote string
+	at   time.Time
+}
+
+// claimVote reports whether vote is new rather than a repeat of the agent's
+// last vote on the project within voteDuplicateWindow, and if so records it
+// in the same critical section, so of two concurrent resends only one is
+// applied. The caller settles the claim with rememberVote once it knows the
+// outcome.
+func claimVote(agentID, projectID int, vote string) bool {
+	recentVotes.Lock()
+	defer recentVotes.Unlock()
+	now := time.Now()
+	for k, v := range recentVotes.m {
+		if now.Sub(v.at) >= voteDuplicateWindow {
+			delete(recentVotes.m, k)
+		}
+	}
+	key := fmt.Sprintf("%d|%d", agentID, projectID)
+	if last, ok := recentVotes.m[key]; ok && last.vote == vote {
+		return false
+	}
+	recentVotes.m[key] = recentVote{vote, now}
+	return true
+}
+
+// rememberVote records the agent's vote on the project now standing, or
+// forgets it once cleared ("").
+func rememberVote(agentID, projectID int, vote string) {
+	recentVotes.Lock()
+	defer recentVotes.Unlock()
+	key := fmt.Sprintf("%d|%d", agentID, projectID)
+	if vote == "" {
+		delete(recentVotes.m, key)
+		return
+	}
+	recentVotes.m[key] = recentVote{vote, time.Now()}
+}
+
+// forgetVotes drops everything remembered about the agent's votes, for when
+// they are removed wholesale.
+func forgetVotes(agentID int) {
+	recentVotes.Lock()
+	defer recentVotes.Unlock()
+	prefix := fmt.Sprintf("%d|", agentID)
+	for k := range recentVotes.m {
+		if strings.HasPrefix(k, prefix) {
+			delete(recentVotes.m, k)
+		}
+	}
+}
+
+// voteOutcome is what applyVote would do to an existing vote oldVote ("" for
+// none) given vote ("" to clear), and the resulting change in score.
+func voteOutcome(oldVote, vote string, toggle bool) (action string, delta float64) {
+	newVote := oldVote
+	switch {
+	case vote == "" && oldVote != "":
+		action, newVote = "removed", ""
+	case vote == "":
+		action = "unchanged"
+	case oldVote == "":
+		action, newVote = "created", vote
+	case oldVote != vote:
+		action, newVote = "switched", vote
+	case toggle:
+		action, newVote = "removed", ""
+	default:
+		action = "unchanged"
+	}
+	return action, voteWeight(newVote) - voteWeight(oldVote)
+}
+
+// handleAPIVote serves /projects/{id}/vote. POST toggles (repeating a vote clears
+// it), PUT sets the vote idempotently, and DELETE clears it. GET previews a vote
+// without casting it.
+func handleAPIVote(w http.ResponseWriter, r *http.Request, projectID int) {
+	if r.Method == "GET" {
+		handleAPIVotePreview(w, r, projectID)
+		return
+	}
+	if r.Method != "POST" && r.Method != "PUT" && r.Method != "DELETE" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	if !checkRateLimit(agent.ID, "vote", rateLimits["vote"]) {
+		jsonErr(w, 429, fmt.Sprintf("rate limit exceeded — max %d votes per hour", rateLimits["vote"]))
+		return
+	}
+	var req struct {
+		Vote string `json:"vote"`
+	}
+	if r.Method != "DELETE" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Vote != "up" && req.Vote != "down") {
+			jsonErr(w, 400, "vote must be 'up' or 'down'")
+			return
+		}
+	}
+	if _, err := getProject(projectID); err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	var submitterID int
+	db.QueryRow("SELECT submitted_by_id FROM projects WHERE id=?", projectID).Scan(&submitterID)
+	if submitterID == agent.ID {
+		jsonErr(w, 403, "you cannot vote on your own project")
+		return
+	}
+
+	if r.Method == "POST" && !claimVote(agent.ID, projectID, req.Vote) {
+		p, _ := getProject(projectID)
+		jsonResp(w, 200, struct {
+			*Project
+			Action string `json:"action"`
+		}{p, "unchanged"})
+		return
+	}
+
+	action, err := castVote(agent.ID, projectID, r.Method, req.Vote)
+	switch {
+	case err != nil:
+		rememberVote(agent.ID, projectID, "")
+		writeErr(w, err, "failed to record vote")
+		return
+	case action == "created" || action == "switched":
+		rememberVote(agent.ID, projectID, req.Vote)
+	case action == "removed" || r.Method == "POST":
+		rememberVote(agent.ID, projectID, "")
+	}
+	if r.Method != "DELETE" || action == "removed" {
+		recordAction(agent.ID, "vote")
+	}
+	checkVoteBurst(projectID)
+	p, _ := getProject(projectID)
+	jsonResp(w, 200, struct {
+		*Project
+		Action string `json:"action"`
+	}{p, action})
+}
+
+// castVote applies a POST, PUT or DELETE vote in one transaction and returns
+// what it did.
+func castVote(agentID, projectID int, method, vote string) (string, error) {
+	var action string
+	err := execWithRetry(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		action = "unchanged"
+		if method != "DELETE" {
+			if action, err = applyVote(tx, agentID, projectID, vote, method == "POST"); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}
+		var oldVote string
+		switch err := tx.QueryRow("SELECT vote_type FROM votes WHERE agent_id=? AND project_id=?", agentID, projectID).Scan(&oldVote); {
+		case err == sql.ErrNoRows:
+			return nil
+		case err != nil:
+			return err
+		}
+		if err := removeVote(tx, agentID, projectID, oldVote); err != nil {
+			return err
+		}
+		action = "removed"
+		return tx.Commit()
+	})
+	return action, err
+}
+
+// handleAPIVotePreview reports the caller's current vote and what casting
+// ?vote=up|down|none would do, with PUT semantics, or POST's with
+// ?toggle=true. Nothing is written and no rate limit is spent.
+func handleAPIVotePreview(w http.ResponseWriter, r *http.Request, projectID int) {
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	q := r.URL.Query()
+	vote := q.Get("vote")
+	switch vote {
+	case "up", "down":
+	case "none":
+		vote = ""
+	default:
+		jsonErr(w, 400, "vote must be 'up', 'down' or 'none'")
+		return
+	}
+	p, err := getProject(projectID)
+	if err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	var submitterID int
+	db.QueryRow("SELECT submitted_by_id FROM projects WHERE id=?", projectID).Scan(&submitterID)
+	if submitterID == agent.ID {
+		jsonErr(w, 403, "you cannot vote on your own project")
+		return
+	}
+	var current string
+	db.QueryRow("SELECT vote_type FROM votes WHERE agent_id=? AND project_id=?", agent.ID, projectID).Scan(&current)
+	action, delta := voteOutcome(current, vote, q.Get("toggle") == "true")
+	var currentVote *string
+	if current != "" {
+		currentVote = &current
+	}
+	jsonResp(w, 200, map[string]interface{}{
+		"project_id":   projectID,
+		"current_vote": currentVote,
+		"vote":         q.Get("vote"),
+		"action":       action,
+		"score":        p.Score,
+		"score_delta":  delta,
+		"score_after":  p.Score + delta,
+	})
+}
+
+// handleAPISimilarProjects lists the projects whose descriptions read most
+// like this one's (?limit=, default 5, at most 20), each with its similarity
+// from 0 to 1.
+func handleAPISimilarProjects(w http.ResponseWriter, r *http.Request, projectID int) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	if !similarProjectsEnabled {
+		jsonErr(w, 404, "similar projects are not enabled on this server")
+		return
+	}
+	if _, err := getProject(projectID); err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	limit := defaultSimilarProjects
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = min(n, maxSimilarProjects)
+	}
+	ids, scores, err := similarTo(projectID, limit)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	type similar struct {
+		*Project
+		Similarity float64 `json:"similarity"`
+	}
+	out := []similar{}
+	for i, id := range ids {
+		if p, err := getProject(id); err == nil {
+			out = append(out, similar{p, math.Round(scores[i]*1000) / 1000})
+		}
+	}
+	jsonResp(w, 200, out)
+}
+
+// handleAPIVoters shows who voted on a project. Everyone gets the counts;
+// only the project's submitter also gets the voters' names.
+func handleAPIVoters(w http.ResponseWriter, r *http.Request, projectID int) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	var submitterID int
+	if err := readDB.QueryRow("SELECT submitted_by_id FROM projects WHERE id=? AND deleted_at IS NULL", projectID).Scan(&submitterID); err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	owner := false
+	if r.Header.Get("Authorization") != "" {
+		agent, err := authAgent(r)
+		if err != nil {
+			authErr(w, err)
+			return
+		}
+		owner = submitterID != 0 && agent.ID == submitterID
+	}
+	rows, err := readDB.Query(`SELECT v.vote_type, a.name FROM votes v JOIN agents a ON a.id = v.agent_id
+		WHERE v.project_id = ? ORDER BY v.created_at, a.name`, projectID)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	defer rows.Close()
+	up, down := []string{}, []string{}
+	for rows.Next() {
+		var vote, name string
+		if err := rows.Scan(&vote, &name); err != nil {
+			jsonErr(w, 500, "database error")
+			return
+		}
+		name = html.UnescapeString(name)
+		if vote == "up" {
+			up = append(up, name)
+		} else {
+			down = append(down, name)
+		}
+	}
+	resp := map[string]interface{}{
+		"upvotes":   len(up),
+		"downvotes": len(down),
+	}
+	if owner {
+		resp["upvoters"] = up
+		resp["downvoters"] = down
+	}
+	jsonResp(w, 200, resp)
+}
+
+// handleAPIUndoLastVote removes the caller's most recent vote, whichever
+// project it was on, and returns that project.
+func handleAPIUndoLastVote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	if !checkRateLimit(agent.ID, "vote", rateLimits["vote"]) {
+		jsonErr(w, 429, fmt.Sprintf("rate limit exceeded — max %d votes per hour", rateLimits["vote"]))
+		return
+	}
+	var projectID int
+	var oldVote string
+	err = execWithRetry(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		// A switched vote counts as cast when it was switched.
+		err = tx.QueryRow("SELECT project_id, vote_type FROM votes WHERE agent_id=? ORDER BY COALESCE(updated_at, created_at) DESC, rowid DESC LIMIT 1", agent.ID).
+			Scan(&projectID, &oldVote)
+		if err != nil {
+			return err
+		}
+		if err := removeVote(tx, agent.ID, projectID, oldVote); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err == sql.ErrNoRows {
+		jsonErrCode(w, 404, "no_votes", "you have no votes to undo")
+		return
+	}
+	if err != nil {
+		writeErr(w, err, "failed to undo vote")
+		return
+	}
+	rememberVote(agent.ID, projectID, "")
+	recordAction(agent.ID, "vote")
+	p, err := getProject(projectID)
+	if err != nil {
+		// The project has since been removed; the vote is gone all the same.
+		jsonResp(w, 200, map[string]interface{}{"project_id": projectID, "removed": oldVote})
+		return
+	}
+	jsonResp(w, 200, p)
+}
+
+const maxBatchVotes = 30
+
+// handleAPIVoteBatch applies several votes in one transaction. Each item is
+// checked like a single vote; failures are reported per item without aborting the rest.
+func handleAPIVoteBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	var req struct {
+		Votes []struct {
+			ProjectID int    `json:"project_id"`
+			Vote      string `json:"vote"`
+		} `json:"votes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
+		return
+	}
+	if len(req.Votes) == 0 {
+		jsonErr(w, 400, "votes is required")
+		return
+	}
+	if len(req.Votes) > maxBatchVotes {
+		jsonErr(w, 400, fmt.Sprintf("at most %d votes per batch", maxBatchVotes))
+		return
+	}
+	// Votes toggle, so a repeated project would cancel itself out while
+	// spending two votes; send one vote per project.
+	seen := make(map[int]bool, len(req.Votes))
+	for _, v := range req.Votes {
+		if seen[v.ProjectID] {
+			jsonErr(w, 400, fmt.Sprintf("project %d appears more than once; send one vote per project", v.ProjectID))
+			return
+		}
+		seen[v.ProjectID] = true
+	}
+	used := countRecentActions(agent.ID, "vote")
+	if used+len(req.Votes) > rateLimits["vote"] {
+		jsonErr(w, 429, fmt.Sprintf("rate limit exceeded — max %d votes per hour, %d remaining", rateLimits["vote"], max(rateLimits["vote"]-used, 0)))
+		return
+	}
+
+	type result struct {
+		ProjectID int    `json:"project_id"`
+		Vote      string `json:"vote"`
+		OK        bool   `json:"ok"`
+		Action    string `json:"action,omitempty"`
+		Error     string `json:"error,omitempty"`
+	}
+	var results, applied []result
+	err = execWithRetry(func() error {
+		results, applied = make([]result, 0, len(req.Votes)), nil
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, v := range req.Votes {
+			res := result{ProjectID: v.ProjectID, Vote: v.Vote}
+			var submitterID int
+			switch err := tx.QueryRow("SELECT submitted_by_id FROM projects WHERE id=? AND deleted_at IS NULL", v.ProjectID).Scan(&submitterID); {
+			case v.Vote != "up" && v.Vote != "down":
+				res.Error = "vote must be 'up' or 'down'"
+			case err == sql.ErrNoRows:
+				res.Error = "project not found"
+			case err != nil:
+				return err
+			case submitterID == agent.ID:
+				res.Error = "you cannot vote on your own project"
+			default:
+				if res.Action, err = applyVote(tx, agent.ID, v.ProjectID, v.Vote, true); err != nil {
+					return err
+				}
+				res.OK = true
+				applied = append(applied, res)
+			}
+			results = append(results, res)
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		writeErr(w, err, "database error")
+		return
+	}
+	for _, res := range applied {
+		switch res.Action {
+		case "created", "switched":
+			rememberVote(agent.ID, res.ProjectID, res.Vote)
+		case "removed":
+			rememberVote(agent.ID, res.ProjectID, "")
+		}
+		recordAction(agent.ID, "vote")
+		checkVoteBurst(res.ProjectID)
+	}
+	jsonResp(w, 200, map[string]interface{}{"results": results})
+}
+
+func handleAPIComments(w http.ResponseWriter, r *http.Request, projectID int) {
+	switch r.Method {
+	case "GET":
+		if _, err := getProject(projectID); err != nil {
+			jsonErr(w, 404, "project not found")
+			return
+		}
+		q := r.URL.Query()
+		var page CommentPage
+		page.Limit, page.Offset = pageParams(r, defaultPageSize)
+		if a, err := strconv.Atoi(q.Get("after")); err == nil && a > 0 {
+			page.After = a
+		}
+		if b, err := strconv.Atoi(q.Get("before")); err == nil && b > 0 {
+			page.Before = b
+		}
+		comments, err := getComments(readDB, projectID, page)
+		if err != nil {
+			jsonErr(w, 500, "database error")
+			return
+		}
+		if comments == nil {
+			comments = []Comment{}
+		}
+		jsonResp(w, 200, comments)
+
+	case "POST":
+		agent, err := authAgent(r)
+		if err != nil {
+			authErr(w, err)
+			return
+		}
+		p, err := getProject(projectID)
+		if err != nil {
+			jsonErr(w, 404, "project not found")
+			return
+		}
+		if p.CommentsLocked {
+			jsonErrCode(w, 403, "comments_locked", "comments are locked")
+			return
+		}
+		var req struct {
+			Body string `json:"body"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
+			return
+		}
+		req.Body = strings.TrimSpace(req.Body)
+		if req.Body == "" {
+			jsonErr(w, 400, "body is required")
+			return
+		}
+		if len(req.Body) > maxCommentLen {
+			jsonErr(w, 400, fmt.Sprintf("comment must be %d characters or less", maxCommentLen))
+			return
+		}
+		if containsBlockedTerm(req.Body) {
+			jsonErr(w, 422, "comment contains a blocked term")
+			return
+		}
+		// A retried POST gets the comment it already created instead of a
+		// duplicate, and doesn't count against the rate limit.
+		var lastID int
+		var lastBody string
+		err = db.QueryRow(
+			"SELECT id, body FROM comments WHERE project_id=? AND agent_id=? AND created_at > ? ORDER BY id DESC LIMIT 1",
+			projectID, agent.ID, time.Now().UTC().Add(-duplicateCommentWindow).Format(dbTimeFormat),
+		).Scan(&lastID, &lastBody)
+		if err == nil && lastBody == sanitize(req.Body) {
+			if c, err := getComment(lastID); err == nil {
+				jsonResp(w, 200, c)
+				return
+			}
+		}
+		if !checkRateLimit(agent.ID, "comment", rateLimits["comment"]) {
+			jsonErr(w, 429, fmt.Sprintf("rate limit exceeded — max %d comments per hour", rateLimits["comment"]))
+			return
+		}
+		if commentCooldown > 0 {
+			var last string
+			if db.QueryRow("SELECT MAX(created_at) FROM comments WHERE agent_id=?", agent.ID).Scan(&last) == nil && last != "" {
+				if wait := time.Until(parseTime(last).Add(commentCooldown)); wait > 0 {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+					jsonErr(w, 429, fmt.Sprintf("slow down — wait %d seconds between comments", int(commentCooldown.Seconds())))
+					return
+				}
+			}
+		}
+
+		var id int64
+		err = execWithRetry(func() error {
+			tx, err := db.Begin()
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			res, err := tx.Exec(
+				"INSERT INTO comments (project_id, agent_id, agent_name, body, created_at) VALUES (?, ?, ?, ?, ?)",
+				projectID, agent.ID, agent.Name, sanitize(req.Body), dbNow(),
+			)
+			if err != nil {
+				return err
+			}
+			id, _ = res.LastInsertId()
+			if err := audit(tx, agent.ID, "comment.create", fmt.Sprintf("comment:%d", id), map[string]interface{}{"project_id": projectID, "body": req.Body}); err != nil {
+				return err
+			}
+			return tx.Commit()
+		})
+		if err != nil {
+			writeErr(w, err, "failed to create comment")
+			return
+		}
+		recordAction(agent.ID, "comment")
+
+		notifySubscribers(projectID, int(id), agent)
+		c, _ := getComment(int(id))
+		jsonResp(w, 201, c)
+
+	default:
+		jsonErr(w, 405, "method not allowed")
+	}
+}
+
+// handleAPICommentEdit lets an author fix a comment's body within
+// commentEditWindow of posting it; after that the comment is fixed.
+func handleAPICommentEdit(w http.ResponseWriter, r *http.Request, projectID, commentID int) {
+	if r.Method != "PATCH" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	c, err := getComment(commentID)
+	if err != nil || c.ProjectID != projectID {
+		jsonErr(w, 404, "comment not found")
+		return
+	}
+	if c.AgentID != agent.ID {
+		jsonErr(w, 403, "you can only edit your own comments")
+		return
+	}
+	if time.Since(c.CreatedAt) > commentEditWindow {
+		jsonErrCode(w, 403, "edit_window_expired", "edit window expired")
+		return
+	}
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
+		return
+	}
+	req.Body = strings.TrimSpace(req.Body)
+	if req.Body == "" {
+		jsonErr(w, 400, "body is required")
+		return
+	}
+	if len(req.Body) > maxCommentLen {
+		jsonErr(w, 400, fmt.Sprintf("comment must be %d characters or less", maxCommentLen))
+		return
+	}
+	if containsBlockedTerm(req.Body) {
+		jsonErr(w, 422, "comment contains a blocked term")
+		return
+	}
+	err = execWithRetry(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec("UPDATE comments SET body = ? WHERE id = ?", sanitize(req.Body), commentID); err != nil {
+			return err
+		}
+		if err := audit(tx, agent.ID, "comment.edit", fmt.Sprintf("comment:%d", commentID), map[string]string{"from": c.Body, "to": req.Body}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		writeErr(w, err, "failed to edit comment")
+		return
 	}
+	c, _ = getComment(commentID)
+	jsonResp(w, 200, c)
+}
 
-	totalCount := getProjectCount(q)
-	totalPages := int(math.Ceil(float64(totalCount) / float64(perPage)))
-	if totalPages < 1 {
-		totalPages = 1
+// handleAPICommentPin lets a project's submitter pin one comment (PUT), which
+// then leads the comment list, or unpin it (DELETE). Pinning another comment
+// replaces the previous pin.
+func handleAPICommentPin(w http.ResponseWriter, r *http.Request, projectID, commentID int) {
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		jsonErr(w, 405, "method not allowed")
+		return
 	}
-	if page > totalPages {
-		page = totalPages
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	var submitterID int
+	if err := db.QueryRow("SELECT submitted_by_id FROM projects WHERE id=? AND deleted_at IS NULL", projectID).Scan(&submitterID); err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	if submitterID == 0 || submitterID != agent.ID {
+		jsonErr(w, 403, "only the project's submitter can pin comments")
+		return
+	}
+	c, err := getComment(commentID)
+	if err != nil || c.ProjectID != projectID {
+		jsonErr(w, 404, "comment not found")
+		return
+	}
+	var changed int64
+	err = execWithRetry(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		action := "comment.pin"
+		if r.Method == "DELETE" {
+			// Only this comment's pin is cleared, and only if it has one.
+			res, err := tx.Exec("UPDATE comments SET pinned = 0 WHERE id = ? AND pinned = 1", commentID)
+			if err != nil {
+				return err
+			}
+			if changed, _ = res.RowsAffected(); changed == 0 {
+				return nil
+			}
+			action = "comment.unpin"
+		} else {
+			if _, err := tx.Exec("UPDATE comments SET pinned = 0 WHERE project_id = ? AND pinned = 1", projectID); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("UPDATE comments SET pinned = 1 WHERE id = ?", commentID); err != nil {
+				return err
+			}
+			changed = 1
+		}
+		if err := audit(tx, agent.ID, action, fmt.Sprintf("comment:%d", commentID), map[string]int{"project_id": projectID}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		writeErr(w, err, "failed to pin comment")
+		return
+	}
+	if changed == 0 {
+		jsonErrCode(w, 409, "not_pinned", "this comment isn't pinned")
+		return
 	}
+	c, _ = getComment(commentID)
+	jsonResp(w, 200, c)
+}
 
-	offset := (page - 1) * perPage
-	projects, _ := getProjects(perPage, offset, q)
-	if projects == nil {
-		projects = []Project{}
+// handleAPICommentsLock closes (PUT) or reopens (DELETE) a project's comments.
+// Existing comments stay readable. The submitter controls their own project;
+// an admin can lock or unlock any project.
+func handleAPICommentsLock(w http.ResponseWriter, r *http.Request, projectID int) {
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	var submitterID int
+	if err := db.QueryRow("SELECT submitted_by_id FROM projects WHERE id=? AND deleted_at IS NULL", projectID).Scan(&submitterID); err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	actorID := 0
+	if !isAdmin(r) {
+		agent, err := authAgent(r)
+		if err != nil {
+			authErr(w, err)
+			return
+		}
+		if submitterID == 0 || submitterID != agent.ID {
+			jsonErr(w, 403, "only the project's submitter can lock comments")
+			return
+		}
+		actorID = agent.ID
+	}
+	locked := r.Method == "PUT"
+	err := execWithRetry(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec("UPDATE projects SET comments_locked = ? WHERE id = ?", locked, projectID); err != nil {
+			return err
+		}
+		if err := audit(tx, actorID, "project.comments_lock", projectTarget(projectID), map[string]bool{"locked": locked}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		writeErr(w, err, "failed to update comment lock")
+		return
 	}
-	stats := getStats()
+	p, _ := getProject(projectID)
+	jsonResp(w, 200, p)
+}
 
-	pag := Pagination{
-		Page:       page,
-		TotalPages: totalPages,
-		HasPrev:    page > 1,
-		HasNext:    page < totalPages,
-		PrevPage:   page - 1,
-		NextPage:   page + 1,
-		Query:      q,
+// Trending tags look at votes from the last few hours (?hours=, default 24).
+const (
+	defaultTrendingHours = 24
+	maxTrendingHours     = 48
+	maxTrendingTags      = 20
+)
+
+// handleAPITrendingTags ranks tags by how many votes their projects received
+// recently, as opposed to how many projects carry them overall.
+func handleAPITrendingTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	hours := defaultTrendingHours
+	if h, err := strconv.Atoi(r.URL.Query().Get("hours")); err == nil && h > 0 && h <= maxTrendingHours {
+		hours = h
+	}
+	rows, err := readDB.Query(`SELECT t.tag, COUNT(*) FROM votes v
+		JOIN project_tags t ON t.project_id = v.project_id
+		JOIN projects p ON p.id = v.project_id
+		WHERE v.created_at > datetime('now', ?) AND p.deleted_at IS NULL
+		GROUP BY t.tag ORDER BY 2 DESC, t.tag LIMIT ?`,
+		fmt.Sprintf("-%d hours", hours), maxTrendingTags)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	defer rows.Close()
+	type trending struct {
+		Tag   string `json:"tag"`
+		Votes int    `json:"votes"`
+	}
+	tags := []trending{}
+	for rows.Next() {
+		var t trending
+		if rows.Scan(&t.Tag, &t.Votes) == nil {
+			tags = append(tags, t)
+		}
+	}
+	jsonResp(w, 200, map[string]interface{}{"hours": hours, "tags": tags})
+}
+
+// --- Subscriptions & Notifications ---
+
+// notifySubscribers queues a notification about a new comment for everyone
+// subscribed to the project except its author.
+func notifySubscribers(projectID, commentID int, author *Agent) {
+	_, err := db.Exec(`INSERT INTO notifications (agent_id, type, project_id, comment_id, actor, created_at)
+		SELECT agent_id, 'comment', ?, ?, ?, ? FROM subscriptions WHERE project_id = ? AND agent_id != ?`,
+		projectID, commentID, author.Name, dbNow(), projectID, author.ID)
+	if err != nil {
+		log.Printf("notify subscribers of project %d: %v", projectID, err)
+	}
+}
+
+// handleAPISubscribe subscribes the caller to a project's new comments (POST)
+// or unsubscribes them (DELETE). Both are idempotent.
+func handleAPISubscribe(w http.ResponseWriter, r *http.Request, projectID int) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	if _, err := getProject(projectID); err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	query, args := "INSERT OR IGNORE INTO subscriptions (agent_id, project_id, created_at) VALUES (?, ?, ?)", []interface{}{agent.ID, projectID, dbNow()}
+	if r.Method == "DELETE" {
+		query, args = "DELETE FROM subscriptions WHERE agent_id = ? AND project_id = ?", []interface{}{agent.ID, projectID}
+	}
+	err = execWithRetry(func() error {
+		_, err := db.Exec(query, args...)
+		return err
+	})
+	if err != nil {
+		writeErr(w, err, "failed to update subscription")
+		return
+	}
+	jsonResp(w, 200, map[string]interface{}{"project_id": projectID, "subscribed": r.Method == "POST"})
+}
+
+// handleAPINotifications lists the caller's notifications, newest first
+// (?unread=true&limit=&offset=).
+func handleAPINotifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	limit, offset := pageParams(r, defaultPageSize)
+	query := `SELECT n.id, n.type, n.project_id, COALESCE(p.name, ''), n.comment_id, n.actor, n.read_at IS NOT NULL, n.created_at
+		FROM notifications n LEFT JOIN projects p ON p.id = n.project_id
+		WHERE n.agent_id = ?`
+	if r.URL.Query().Get("unread") == "true" {
+		query += " AND n.read_at IS NULL"
+	}
+	rows, err := readDB.Query(query+" ORDER BY n.id DESC LIMIT ? OFFSET ?", agent.ID, limit, offset)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	defer rows.Close()
+	items := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var t string
+		if err := rows.Scan(&n.ID, &n.Type, &n.ProjectID, &n.ProjectName, &n.CommentID, &n.Actor, &n.Read, &t); err != nil {
+			jsonErr(w, 500, "database error")
+			return
+		}
+		n.ProjectName = html.UnescapeString(n.ProjectName)
+		n.CreatedAt = parseTime(t)
+		items = append(items, n)
+	}
+	jsonResp(w, 200, items)
+}
+
+// handleAPINotificationsRead marks all of the caller's notifications read.
+func handleAPINotificationsRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
+		return
+	}
+	res, err := db.Exec("UPDATE notifications SET read_at = ? WHERE agent_id = ? AND read_at IS NULL", dbNow(), agent.ID)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	n, _ := res.RowsAffected()
+	jsonResp(w, 200, map[string]int64{"marked_read": n})
+}
+
+// Traffic history covers the last ?days= UTC days, today included.
+const (
+	defaultTrafficDays = 30
+	maxTrafficDays     = 90
+)
+
+// handleAPITrafficHistory returns daily request and unique-visitor totals,
+// oldest first, with zeros for days without traffic. Today's bucket is live.
+func handleAPITrafficHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	days := defaultTrafficDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTrafficDays {
+			jsonErr(w, 400, fmt.Sprintf("days must be between 1 and %d", maxTrafficDays))
+			return
+		}
+		days = n
+	}
+	today := tracker.Today()
+	end, _ := time.Parse("2006-01-02", today.Day)
+	start := end.AddDate(0, 0, -(days - 1)).Format("2006-01-02")
+	stored := make(map[string]dailyTraffic)
+	rows, err := readDB.Query("SELECT day, requests, unique_visitors FROM traffic_daily WHERE day >= ? AND day <= ?", start, today.Day)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d dailyTraffic
+		if rows.Scan(&d.Day, &d.Requests, &d.UniqueVisitors) == nil {
+			stored[d.Day] = d
+		}
 	}
-
-	renderPage(w, "home", map[string]interface{}{
-		"Projects":   projects,
-		"Stats":      stats,
-		"Query":      q,
-		"Pagination": pag,
-		"Offset":     offset,
-	})
+	stored[today.Day] = today
+	history := make([]dailyTraffic, days)
+	for i := range history {
+		day := end.AddDate(0, 0, i-(days-1)).Format("2006-01-02")
+		history[i] = dailyTraffic{Day: day}
+		if d, ok := stored[day]; ok {
+			history[i] = d
+		}
+	}
+	jsonResp(w, 200, map[string]interface{}{"days": history})
 }
 
-func handleSearch(w http.ResponseWriter, r *http.Request) {
-	q := strings.TrimSpace(r.URL.Query().Get("q"))
-	http.Redirect(w, r, "/?q="+q, http.StatusSeeOther)
+// Sentiment covers the last ?days= UTC days, today included.
+const (
+	defaultSentimentDays = 30
+	maxSentimentDays     = 90
+)
+
+type dailySentiment struct {
+	Day       string `json:"day"`
+	Upvotes   int    `json:"upvotes"`
+	Downvotes int    `json:"downvotes"`
 }
 
-func handleProject(w http.ResponseWriter, r *http.Request) {
-	idStr := strings.TrimPrefix(r.URL.Path, "/project/")
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		http.NotFound(w, r)
+// handleAPISentiment returns site-wide upvotes and downvotes per day, oldest
+// first, with zeros for days without votes. Votes count on the day they were
+// first cast; a switched vote counts under its current direction.
+func handleAPISentiment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
 		return
 	}
-	p, err := getProject(id)
+	days := defaultSentimentDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSentimentDays {
+			jsonErr(w, 400, fmt.Sprintf("days must be between 1 and %d", maxSentimentDays))
+			return
+		}
+		days = n
+	}
+	end := time.Now().UTC()
+	start := end.AddDate(0, 0, -(days - 1)).Format("2006-01-02")
+	rows, err := readDB.Query(`SELECT date(v.created_at) AS day,
+			SUM(CASE WHEN v.vote_type = 'up' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN v.vote_type = 'down' THEN 1 ELSE 0 END)
+		FROM votes v JOIN projects p ON p.id = v.project_id
+		WHERE v.created_at >= ? AND p.deleted_at IS NULL
+		GROUP BY day`, start)
 	if err != nil {
-		http.NotFound(w, r)
+		jsonErr(w, 500, "database error")
 		return
 	}
-	comments, _ := getComments(id)
-	if comments == nil {
-		comments = []Comment{}
+	defer rows.Close()
+	stored := make(map[string]dailySentiment)
+	for rows.Next() {
+		var d dailySentiment
+		if rows.Scan(&d.Day, &d.Upvotes, &d.Downvotes) == nil {
+			stored[d.Day] = d
+		}
 	}
-	renderPage(w, "project", map[string]interface{}{
-		"Project":  p,
-		"Comments": comments,
+	history := make([]dailySentiment, days)
+	var up, down int
+	for i := range history {
+		day := end.AddDate(0, 0, i-(days-1)).Format("2006-01-02")
+		history[i] = dailySentiment{Day: day}
+		if d, ok := stored[day]; ok {
+			history[i] = d
+		}
+		up += history[i].Upvotes
+		down += history[i].Downvotes
+	}
+	jsonResp(w, 200, map[string]interface{}{
+		"days":      history,
+		"upvotes":   up,
+		"downvotes": down,
 	})
 }
 
-func handleSkillMD(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
-	w.Write(skillMD)
-}
-
-func handleSubmit(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
-		renderPage(w, "submit", nil)
+func handleAPITraffic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
 		return
 	}
-	http.Error(w, "Use the API to submit projects: POST /api/v1/projects", http.StatusMethodNotAllowed)
+	stats := tracker.Stats()
+	// Add app stats
+	appStats := getStats(readDB)
+	stats["projects"] = appStats.TotalProjects
+	stats["agents"] = appStats.TotalAgents
+	stats["votes"] = appStats.TotalVotes
+	var commentCount int
+	readDB.QueryRow("SELECT COUNT(*) FROM comments").Scan(&commentCount)
+	stats["comments"] = commentCount
+	// Growth since midnight UTC
+	for key, table := range map[string]string{
+		"projects_today": "projects",
+		"agents_today":   "agents",
+		"votes_today":    "votes",
+		"comments_today": "comments",
+	} {
+		var n int
+		readDB.QueryRow("SELECT COUNT(*) FROM " + table + " WHERE created_at >= date('now')").Scan(&n)
+		stats[key] = n
+	}
+	jsonResp(w, 200, stats)
 }
 
-// --- API Handlers ---
-
-func handleAPIRegister(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
+func handleAPISearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
 		jsonErr(w, 405, "method not allowed")
 		return
 	}
-	var req struct {
-		Name        string `json:"name"`
-		Description string `json:"description"`
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		jsonErr(w, 400, "q parameter is required")
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonErr(w, 400, "invalid JSON body")
+	if len(q) > maxSearchQueryLen {
+		jsonErr(w, 400, "search query too long")
 		return
 	}
-
-	req.Name = strings.TrimSpace(req.Name)
-	req.Description = strings.TrimSpace(req.Description)
-
-	if msg := validateAgentInput(req.Name, req.Description); msg != "" {
-		jsonErr(w, 400, msg)
+	limit, offset := pageParams(r, maxSearchResults)
+	projects, err := getProjects(readDB, limit, offset, ProjectFilter{Search: q, SafeOnly: r.URL.Query().Get("safe") == "true"})
+	if err != nil {
+		jsonErr(w, 500, "search failed")
 		return
 	}
+	if projects == nil {
+		projects = []Project{}
+	}
+	jsonResp(w, 200, projectsResponse(r, projects))
+}
 
-	var existing int
-	err := db.QueryRow("SELECT id FROM agents WHERE LOWER(name)=LOWER(?)", req.Name).Scan(&existing)
-	if err == nil {
-		jsonErr(w, 409, "agent name already taken")
+// handleAPISearchComments finds comments whose body contains q, newest first,
+// each with the name of the project it was posted on. It pages on its own
+// (?limit=&offset=) so it can be combined freely with project search.
+func handleAPISearchComments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
 		return
 	}
-
-	key := generateAPIKey()
-	_, err = db.Exec("INSERT INTO agents (name, api_key, description) VALUES (?, ?, ?)",
-		sanitize(req.Name), key, sanitize(req.Description))
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		jsonErr(w, 400, "q parameter is required")
+		return
+	}
+	if len(q) > maxSearchQueryLen {
+		jsonErr(w, 400, "search query too long")
+		return
+	}
+	limit, offset := pageParams(r, maxSearchResults)
+	where := "c.body LIKE ?"
+	if r.URL.Query().Get("safe") == "true" {
+		where += " AND p.nsfw = 0"
+	}
+	results, err := getCommentsWithProject(readDB, where, []interface{}{"%" + q + "%"}, limit, offset)
 	if err != nil {
-		jsonErr(w, 500, "failed to create agent")
+		jsonErr(w, 500, "search failed")
 		return
 	}
-	jsonResp(w, 201, map[string]string{
-		"api_key": key,
-		"name":    req.Name,
-		"message": "Save your api_key! You need it for all authenticated requests.",
-	})
+	jsonResp(w, 200, results)
 }
 
-func handleAPIMe(w http.ResponseWriter, r *http.Request) {
+func handleAPIAdminFlags(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		jsonErr(w, 405, "method not allowed")
 		return
 	}
-	agent, err := authAgent(r)
+	if !requireAdmin(w, r) {
+		return
+	}
+	rows, err := db.Query(`SELECT id, suspicious FROM projects p
+		WHERE suspicious = 1 OR EXISTS (SELECT 1 FROM flags f WHERE f.project_id = p.id)
+		ORDER BY suspicious DESC, (SELECT COUNT(*) FROM flags f WHERE f.project_id = p.id) DESC, id DESC
+		LIMIT 100`)
 	if err != nil {
-		jsonErr(w, 401, err.Error())
+		jsonErr(w, 500, "database error")
 		return
 	}
-	agent.APIKey = ""
-	db.QueryRow("SELECT COUNT(*) FROM projects WHERE submitted_by_id=?", agent.ID).Scan(&agent.ProjectsSubmitted)
-	db.QueryRow("SELECT COUNT(*) FROM votes WHERE agent_id=?", agent.ID).Scan(&agent.VotesCast)
-	jsonResp(w, 200, agent)
-}
+	type flagged struct {
+		id         int
+		suspicious bool
+	}
+	var ids []flagged
+	for rows.Next() {
+		var f flagged
+		if rows.Scan(&f.id, &f.suspicious) == nil {
+			ids = append(ids, f)
+		}
+	}
+	rows.Close()
 
-func handleAPIProjects(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		q := strings.TrimSpace(r.URL.Query().Get("q"))
-		limit := 50
-		offset := 0
-		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 100 {
-			limit = l
+	type entry struct {
+		Project    *Project       `json:"project"`
+		Flags      map[string]int `json:"flags"`
+		Suspicious bool           `json:"suspicious"`
+	}
+	out := []entry{}
+	for _, f := range ids {
+		p, err := getProject(f.id)
+		if err != nil {
+			continue
+		}
+		e := entry{Project: p, Flags: map[string]int{}, Suspicious: f.suspicious}
+		fr, err := db.Query("SELECT reason, COUNT(*) FROM flags WHERE project_id=? GROUP BY reason", f.id)
+		if err == nil {
+			for fr.Next() {
+				var reason string
+				var n int
+				if fr.Scan(&reason, &n) == nil {
+					e.Flags[reason] = n
+				}
+			}
+			fr.Close()
 		}
-		if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && o >= 0 {
-			offset = o
+		out = append(out, e)
+	}
+	jsonResp(w, 200, out)
+}
+
+// adminAgentSorts maps each admin agents ?sort= option to its ORDER BY clause.
+var adminAgentSorts = map[string]string{
+	"created_at":         "a.created_at DESC, a.id DESC",
+	"votes_cast":         "votes_cast DESC, a.created_at DESC",
+	"projects_submitted": "projects_submitted DESC, a.created_at DESC",
+	"comments":           "comments DESC, a.created_at DESC",
+}
+
+// handleAPIAdminAgents lists every agent with activity counts, for spotting
+// fresh accounts that vote heavily. Filters: ?created_after= and
+// ?created_before= (RFC 3339 or YYYY-MM-DD), ?sort= (see adminAgentSorts),
+// ?limit=&offset=.
+func handleAPIAdminAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	conds := []string{"a.id != ?"}
+	args := []interface{}{systemAgentID}
+	for _, f := range []struct{ param, op string }{{"created_after", ">="}, {"created_before", "<"}} {
+		v := q.Get(f.param)
+		if v == "" {
+			continue
 		}
-		projects, err := getProjects(limit, offset, q)
+		t, err := time.Parse(time.RFC3339, v)
 		if err != nil {
-			jsonErr(w, 500, "database error")
+			if t, err = time.Parse("2006-01-02", v); err != nil {
+				jsonErr(w, 400, f.param+" must be RFC 3339 or YYYY-MM-DD")
+				return
+			}
+		}
+		conds = append(conds, "a.created_at "+f.op+" ?")
+		args = append(args, t.UTC().Format(dbTimeFormat))
+	}
+	order := adminAgentSorts["created_at"]
+	if s := q.Get("sort"); s != "" {
+		var ok bool
+		if order, ok = adminAgentSorts[s]; !ok {
+			jsonErr(w, 400, "sort must be created_at, votes_cast, projects_submitted or comments")
 			return
 		}
-		if projects == nil {
-			projects = []Project{}
+	}
+	limit, offset := pageParams(r, defaultPageSize)
+	where := " WHERE " + strings.Join(conds, " AND ")
+	var total int
+	db.QueryRow("SELECT COUNT(*) FROM agents a"+where, args...).Scan(&total)
+	rows, err := db.Query(`SELECT a.id, a.name, a.description, a.created_at,
+			(SELECT COUNT(*) FROM projects p WHERE p.submitted_by_id = a.id) AS projects_submitted,
+			(SELECT COUNT(*) FROM votes v WHERE v.agent_id = a.id) AS votes_cast,
+			(SELECT COUNT(*) FROM comments c WHERE c.agent_id = a.id) AS comments
+		FROM agents a`+where+" ORDER BY "+order+" LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	defer rows.Close()
+	type adminAgent struct {
+		ID                int       `json:"id"`
+		Name              string    `json:"name"`
+		Description       string    `json:"description"`
+		CreatedAt         time.Time `json:"created_at"`
+		ProjectsSubmitted int       `json:"projects_submitted"`
+		VotesCast         int       `json:"votes_cast"`
+		Comments          int       `json:"comments"`
+	}
+	agents := []adminAgent{}
+	for rows.Next() {
+		var a adminAgent
+		var t string
+		if err := rows.Scan(&a.ID, &a.Name, &a.Description, &t, &a.ProjectsSubmitted, &a.VotesCast, &a.Comments); err != nil {
+			jsonErr(w, 500, "database error")
+			return
 		}
-		jsonResp(w, 200, projects)
+		a.Name = html.UnescapeString(a.Name)
+		a.Description = html.UnescapeString(a.Description)
+		a.CreatedAt = parseTime(t)
+		agents = append(agents, a)
+	}
+	jsonResp(w, 200, map[string]interface{}{"agents": agents, "total": total})
+}
 
-	case "POST":
-		agent, err := authAgent(r)
+// handleAPIAdminAudit pages through audit_log, newest first. Filters:
+// ?agent_id=, ?action= (e.g. vote.create), ?target= (e.g. project:3),
+// ?limit=&offset=.
+func handleAPIAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	var conds []string
+	var args []interface{}
+	if v := q.Get("agent_id"); v != "" {
+		id, err := strconv.Atoi(v)
 		if err != nil {
-			jsonErr(w, 401, err.Error())
-			return
-		}
-		if !checkRateLimit(agent.ID, "submit", 3) {
-			jsonErr(w, 429, "rate limit exceeded — max 3 project submissions per hour")
+			jsonErr(w, 400, "agent_id must be an integer")
 			return
 		}
-		var req struct {
-			Name        string `json:"name"`
-			URL         string `json:"url"`
-			Description string `json:"description"`
+		conds = append(conds, "l.agent_id = ?")
+		args = append(args, id)
+	}
+	for _, col := range []string{"action", "target"} {
+		if v := q.Get(col); v != "" {
+			conds = append(conds, "l."+col+" = ?")
+			args = append(args, v)
 		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			jsonErr(w, 400, "invalid JSON body")
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+	limit, offset := pageParams(r, defaultPageSize)
+	var total int
+	db.QueryRow("SELECT COUNT(*) FROM audit_log l"+where, args...).Scan(&total)
+	rows, err := db.Query(`SELECT l.id, l.agent_id, COALESCE(a.name, ''), l.action, l.target, l.detail, l.created_at
+		FROM audit_log l LEFT JOIN agents a ON a.id = l.agent_id`+where+" ORDER BY l.id DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	defer rows.Close()
+	type auditEntry struct {
+		ID        int             `json:"id"`
+		AgentID   int             `json:"agent_id"`
+		AgentName string          `json:"agent_name,omitempty"`
+		Action    string          `json:"action"`
+		Target    string          `json:"target"`
+		Detail    json.RawMessage `json:"detail"`
+		CreatedAt time.Time       `json:"created_at"`
+	}
+	entries := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		var detail, t string
+		if err := rows.Scan(&e.ID, &e.AgentID, &e.AgentName, &e.Action, &e.Target, &detail, &t); err != nil {
+			jsonErr(w, 500, "database error")
 			return
 		}
-		req.Name = strings.TrimSpace(req.Name)
-		req.URL = strings.TrimSpace(req.URL)
-		req.Description = strings.TrimSpace(req.Description)
-		if msg := validateProjectInput(req.Name, req.URL, req.Description); msg != "" {
-			jsonErr(w, 400, msg)
-			return
+		e.AgentName = html.UnescapeString(e.AgentName)
+		e.Detail = json.RawMessage(detail)
+		e.CreatedAt = parseTime(t)
+		entries = append(entries, e)
+	}
+	jsonResp(w, 200, map[string]interface{}{"entries": entries, "total": total, "enabled": auditLogEnabled})
+}
+
+// handleAPIAdminStats reports site totals plus submission counts by source.
+func handleAPIAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	stats := getStats(db)
+	var comments int
+	db.QueryRow("SELECT COUNT(*) FROM comments").Scan(&comments)
+	sources := map[string]int{}
+	rows, err := db.Query("SELECT COALESCE(NULLIF(source, ''), 'api'), COUNT(*) FROM projects WHERE deleted_at IS NULL GROUP BY 1")
+	if err != nil {
+		jsonErr(w, 500, "database error")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var source string
+		var n int
+		if rows.Scan(&source, &n) == nil {
+			sources[html.UnescapeString(source)] = n
 		}
-		var existingID int
-		err = db.QueryRow("SELECT id FROM projects WHERE LOWER(url)=LOWER(?)", req.URL).Scan(&existingID)
-		if err == nil {
-			jsonErr(w, 409, fmt.Sprintf("project with this URL already exists (id: %d)", existingID))
-			return
+	}
+	jsonResp(w, 200, map[string]interface{}{
+		"projects": stats.TotalProjects,
+		"agents":   stats.TotalAgents,
+		"votes":    stats.TotalVotes,
+		"comments": comments,
+		"sources":  sources,
+	})
+}
+
+// maintenanceMu serializes admin maintenance runs.
+var maintenanceMu sync.Mutex
+
+// dbFileSize returns the combined size of the database file and its WAL.
+func dbFileSize() int64 {
+	var size int64
+	for _, f := range []string{dbPath(), dbPath() + "-wal"} {
+		if fi, err := os.Stat(f); err == nil {
+			size += fi.Size()
 		}
-		res, err := db.Exec(
-			"INSERT INTO projects (name, url, description, submitted_by, submitted_by_id) VALUES (?, ?, ?, ?, ?)",
-			sanitize(req.Name), req.URL, sanitize(req.Description), agent.Name, agent.ID,
-		)
-		if err != nil {
-			jsonErr(w, 500, "failed to create project")
+	}
+	return size
+}
+
+// handleAPIAdminMaintenance checkpoints and truncates the WAL and, with
+// {"vacuum": true}, rebuilds the database file to reclaim free pages.
+func handleAPIAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req struct {
+		Vacuum bool `json:"vacuum"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
 			return
 		}
-		recordAction(agent.ID, "submit")
-		id, _ := res.LastInsertId()
-		p, _ := getProject(int(id))
-		jsonResp(w, 201, p)
+	}
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
 
-	default:
-		jsonErr(w, 405, "method not allowed")
+	start := time.Now()
+	before := dbFileSize()
+	if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		jsonErr(w, 500, "checkpoint failed: "+err.Error())
+		return
 	}
+	if req.Vacuum {
+		if _, err := db.Exec("VACUUM"); err != nil {
+			jsonErr(w, 500, "vacuum failed: "+err.Error())
+			return
+		}
+		// VACUUM writes through the WAL; truncate it again so the size reflects the result.
+		db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	}
+	after := dbFileSize()
+	log.Printf("maintenance: vacuum=%v, %d -> %d bytes", req.Vacuum, before, after)
+	jsonResp(w, 200, map[string]interface{}{
+		"vacuumed":    req.Vacuum,
+		"size_before": before,
+		"size_after":  after,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
 }
 
-func handleAPIProjectRoute(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/api/v1/projects/")
-	parts := strings.Split(path, "/")
+// --- Export & Import ---
 
-	if parts[0] == "" {
-		jsonErr(w, 400, "missing project id")
+// exportDoc is the admin backup format: every agent (with its api key) and
+// every visible project with its tags, comments and votes. Ids are the source
+// database's; import remaps them.
+type exportDoc struct {
+	Version  int             `json:"version"`
+	Agents   []exportAgent   `json:"agents"`
+	Projects []exportProject `json:"projects"`
+	Comments []exportComment `json:"comments"`
+	Votes    []exportVote    `json:"votes"`
+}
+
+type exportAgent struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	APIKey      string    `json:"api_key"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type exportProject struct {
+	ID            int       `json:"id"`
+	Name          string    `json:"name"`
+	URL           string    `json:"url"`
+	Description   string    `json:"description"`
+	SubmittedBy   string    `json:"submitted_by"`
+	SubmittedByID int       `json:"submitted_by_id"`
+	Upvotes       int       `json:"upvotes"`
+	Downvotes     int       `json:"downvotes"`
+	NSFW          bool      `json:"nsfw"`
+	Source        string    `json:"source"`
+	Tags          []string  `json:"tags"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type exportComment struct {
+	ID        int       `json:"id"`
+	ProjectID int       `json:"project_id"`
+	AgentID   int       `json:"agent_id"`
+	AgentName string    `json:"agent_name"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type exportVote struct {
+	AgentID   int       `json:"agent_id"`
+	ProjectID int       `json:"project_id"`
+	Vote      string    `json:"vote"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	exportVersion  = 1
+	maxImportBytes = 64 << 20
+)
+
+func handleAPIAdminExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	if !requireAdmin(w, r) {
 		return
 	}
-
-	id, err := strconv.Atoi(parts[0])
+	doc, err := exportDB()
 	if err != nil {
-		jsonErr(w, 400, "invalid project id")
+		jsonErr(w, 500, "export failed")
 		return
 	}
+	jsonResp(w, 200, doc)
+}
 
-	if len(parts) == 1 {
-		if r.Method == "PATCH" {
-			handleAPIProjectUpdate(w, r, id)
-			return
-		}
-		if r.Method != "GET" {
-			jsonErr(w, 405, "method not allowed")
+// handleAPIProjectExport returns one project with all its comments and a vote
+// summary, for its submitter (or an admin) to back it up or move it. Votes are
+// summarized without voter identities; the submitter can still list voters
+// through /voters.
+func handleAPIProjectExport(w http.ResponseWriter, r *http.Request, projectID int) {
+	if r.Method != "GET" {
+		jsonErr(w, 405, "method not allowed")
+		return
+	}
+	var submitterID int
+	if err := db.QueryRow("SELECT submitted_by_id FROM projects WHERE id=? AND deleted_at IS NULL", projectID).Scan(&submitterID); err != nil {
+		jsonErr(w, 404, "project not found")
+		return
+	}
+	if !isAdmin(r) {
+		agent, err := authAgent(r)
+		if err != nil {
+			authErr(w, err)
 			return
 		}
-		p, err := getProject(id)
-		if err != nil {
-			jsonErr(w, 404, "project not found")
+		if submitterID == 0 || submitterID != agent.ID {
+			jsonErr(w, 403, "only the project's submitter can export it")
 			return
 		}
-		jsonResp(w, 200, p)
-		return
 	}
-
-	if len(parts) == 2 && parts[1] == "vote" {
-		handleAPIVote(w, r, id)
+	p, err := getProject(projectID)
+	if err != nil {
+		jsonErr(w, 404, "project not found")
 		return
 	}
-
-	if len(parts) == 2 && parts[1] == "comments" {
-		handleAPIComments(w, r, id)
+	rows, err := db.Query("SELECT id, project_id, agent_id, agent_name, body, pinned, created_at FROM comments WHERE project_id=? ORDER BY id", projectID)
+	if err != nil {
+		jsonErr(w, 500, "database error")
 		return
 	}
-
-	jsonErr(w, 404, "not found")
+	defer rows.Close()
+	comments := []Comment{}
+	for rows.Next() {
+		var c Comment
+		var t string
+		if err := rows.Scan(&c.ID, &c.ProjectID, &c.AgentID, &c.AgentName, &c.Body, &c.Pinned, &t); err != nil {
+			jsonErr(w, 500, "database error")
+			return
+		}
+		c.CreatedAt = parseTime(t)
+		c.Body = html.UnescapeString(c.Body)
+		comments = append(comments, c)
+	}
+	type voteSummary struct {
+		Upvotes     int        `json:"upvotes"`
+		Downvotes   int        `json:"downvotes"`
+		FirstVoteAt *time.Time `json:"first_vote_at"`
+		LastVoteAt  *time.Time `json:"last_vote_at"`
+	}
+	var votes voteSummary
+	var first, last sql.NullString
+	db.QueryRow(`SELECT COALESCE(SUM(vote_type = 'up'), 0), COALESCE(SUM(vote_type = 'down'), 0), MIN(created_at), MAX(created_at)
+		FROM votes WHERE project_id = ?`, projectID).Scan(&votes.Upvotes, &votes.Downvotes, &first, &last)
+	if first.Valid {
+		f, l := parseTime(first.String), parseTime(last.String)
+		votes.FirstVoteAt, votes.LastVoteAt = &f, &l
+	}
+	jsonResp(w, 200, map[string]interface{}{
+		"version":     exportVersion,
+		"exported_at": time.Now().UTC(),
+		"project":     p,
+		"comments":    comments,
+		"votes":       votes,
+	})
 }
 
-func handleAPIProjectUpdate(w http.ResponseWriter, r *http.Request, projectID int) {
-	adminKey := os.Getenv("ADMIN_KEY")
-	if adminKey == "" {
-		jsonErr(w, 403, "admin endpoint not configured")
-		return
+// exportDB reads the whole export in one transaction so the parts agree.
+func exportDB() (*exportDoc, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
 	}
-	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	if auth != adminKey {
-		jsonErr(w, 403, "forbidden")
-		return
+	defer tx.Rollback()
+	doc := &exportDoc{
+		Version:  exportVersion,
+		Agents:   []exportAgent{},
+		Projects: []exportProject{},
+		Comments: []exportComment{},
+		Votes:    []exportVote{},
 	}
-	var req struct {
-		Description *string `json:"description"`
-		Name        *string `json:"name"`
-		URL         *string `json:"url"`
+	scan := func(query string, row func(*sql.Rows) error) error {
+		rows, err := tx.Query(query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := row(rows); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonErr(w, 400, "invalid json")
-		return
+	var t string
+	err = scan("SELECT id, name, api_key, description, created_at FROM agents ORDER BY id", func(rows *sql.Rows) error {
+		var a exportAgent
+		if err := rows.Scan(&a.ID, &a.Name, &a.APIKey, &a.Description, &t); err != nil {
+			return err
+		}
+		a.CreatedAt = parseTime(t)
+		doc.Agents = append(doc.Agents, a)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if req.Description != nil {
-		db.Exec("UPDATE projects SET description = ? WHERE id = ?", *req.Description, projectID)
+	tags := map[int][]string{}
+	err = scan("SELECT project_id, tag FROM project_tags ORDER BY project_id, tag", func(rows *sql.Rows) error {
+		var id int
+		var tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return err
+		}
+		tags[id] = append(tags[id], tag)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if req.Name != nil {
-		db.Exec("UPDATE projects SET name = ? WHERE id = ?", *req.Name, projectID)
+	err = scan(`SELECT id, name, url, description, submitted_by, submitted_by_id, upvotes, downvotes, nsfw, source, created_at
+		FROM projects WHERE deleted_at IS NULL ORDER BY id`, func(rows *sql.Rows) error {
+		var p exportProject
+		if err := rows.Scan(&p.ID, &p.Name, &p.URL, &p.Description, &p.SubmittedBy, &p.SubmittedByID,
+			&p.Upvotes, &p.Downvotes, &p.NSFW, &p.Source, &t); err != nil {
+			return err
+		}
+		p.CreatedAt = parseTime(t)
+		p.Tags = tags[p.ID]
+		if p.Tags == nil {
+			p.Tags = []string{}
+		}
+		doc.Projects = append(doc.Projects, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if req.URL != nil {
-		db.Exec("UPDATE projects SET url = ? WHERE id = ?", *req.URL, projectID)
+	err = scan(`SELECT c.id, c.project_id, c.agent_id, c.agent_name, c.body, c.created_at
+		FROM comments c JOIN projects p ON p.id = c.project_id WHERE p.deleted_at IS NULL ORDER BY c.id`, func(rows *sql.Rows) error {
+		var c exportComment
+		if err := rows.Scan(&c.ID, &c.ProjectID, &c.AgentID, &c.AgentName, &c.Body, &t); err != nil {
+			return err
+		}
+		c.CreatedAt = parseTime(t)
+		doc.Comments = append(doc.Comments, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	p, err := getProject(projectID)
+	err = scan(`SELECT v.agent_id, v.project_id, v.vote_type, v.created_at
+		FROM votes v JOIN projects p ON p.id = v.project_id WHERE p.deleted_at IS NULL ORDER BY v.rowid`, func(rows *sql.Rows) error {
+		var v exportVote
+		if err := rows.Scan(&v.AgentID, &v.ProjectID, &v.Vote, &t); err != nil {
+			return err
+		}
+		v.CreatedAt = parseTime(t)
+		doc.Votes = append(doc.Votes, v)
+		return nil
+	})
 	if err != nil {
-		jsonErr(w, 404, "project not found")
-		return
+		return nil, err
 	}
-	jsonResp(w, 200, p)
+	return doc, nil
 }
 
-func handleAPIVote(w http.ResponseWriter, r *http.Request, projectID int) {
+// validate checks the document's shape before anything is written.
+func (d *exportDoc) validate() error {
+	if d.Version != exportVersion {
+		return fmt.Errorf("unsupported export version %d (want %d)", d.Version, exportVersion)
+	}
+	agents := map[int]bool{}
+	for i, a := range d.Agents {
+		if a.ID <= 0 || a.Name == "" || a.APIKey == "" {
+			return fmt.Errorf("agents[%d]: id, name and api_key are required", i)
+		}
+		if agents[a.ID] {
+			return fmt.Errorf("agents[%d]: duplicate id %d", i, a.ID)
+		}
+		agents[a.ID] = true
+	}
+	projects := map[int]bool{}
+	for i, p := range d.Projects {
+		if p.ID <= 0 || p.Name == "" || p.URL == "" {
+			return fmt.Errorf("projects[%d]: id, name and url are required", i)
+		}
+		if msg := validateURL(p.URL); msg != "" {
+			return fmt.Errorf("projects[%d]: %s", i, msg)
+		}
+		if projects[p.ID] {
+			return fmt.Errorf("projects[%d]: duplicate id %d", i, p.ID)
+		}
+		projects[p.ID] = true
+	}
+	for i, c := range d.Comments {
+		if !projects[c.ProjectID] || !agents[c.AgentID] || c.Body == "" {
+			return fmt.Errorf("comments[%d]: needs a body and a project_id and agent_id from this document", i)
+		}
+	}
+	for i, v := range d.Votes {
+		if !projects[v.ProjectID] || !agents[v.AgentID] || (v.Vote != "up" && v.Vote != "down") {
+			return fmt.Errorf("votes[%d]: needs vote 'up' or 'down' and a project_id and agent_id from this document", i)
+		}
+	}
+	return nil
+}
+
+// importTime formats an imported timestamp for storage, using now when unset.
+func importTime(t time.Time) string {
+	if t.IsZero() {
+		return dbNow()
+	}
+	return t.UTC().Format(dbTimeFormat)
+}
+
+// handleAPIAdminImport loads an export into this database in one transaction.
+// Agents that already exist by name and projects that already exist by URL
+// are skipped, along with comments and votes on skipped projects and any
+// vote repeating one already recorded; everything else gets new ids.
+func handleAPIAdminImport(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		jsonErr(w, 405, "method not allowed")
 		return
 	}
-	agent, err := authAgent(r)
-	if err != nil {
-		jsonErr(w, 401, err.Error())
+	if !requireAdmin(w, r) {
 		return
 	}
-	if !checkRateLimit(agent.ID, "vote", 30) {
-		jsonErr(w, 429, "rate limit exceeded — max 30 votes per hour")
+	var doc exportDoc
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportBytes)).Decode(&doc); err != nil {
+		jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
 		return
 	}
-	var req struct {
-		Vote string `json:"vote"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Vote != "up" && req.Vote != "down") {
-		jsonErr(w, 400, "vote must be 'up' or 'down'")
+	if err := doc.validate(); err != nil {
+		jsonErr(w, 400, err.Error())
 		return
 	}
-	if _, err := getProject(projectID); err != nil {
-		jsonErr(w, 404, "project not found")
-		return
+
+	type counts struct {
+		Imported int `json:"imported"`
+		Skipped  int `json:"skipped"`
 	}
-	var submitterID int
-	db.QueryRow("SELECT submitted_by_id FROM projects WHERE id=?", projectID).Scan(&submitterID)
-	if submitterID == agent.ID {
-		jsonErr(w, 403, "you cannot vote on your own project")
-		return
+	type rename struct {
+		From string `json:"from"`
+		To   string `json:"to"`
 	}
-
-	var oldVote string
-	err = db.QueryRow("SELECT vote_type FROM votes WHERE agent_id=? AND project_id=?", agent.ID, projectID).Scan(&oldVote)
-
-	tx, _ := db.Begin()
-	defer tx.Rollback()
-
-	if err == sql.ErrNoRows {
-		tx.Exec("INSERT INTO votes (agent_id, project_id, vote_type) VALUES (?,?,?)", agent.ID, projectID, req.Vote)
-		if req.Vote == "up" {
-			tx.Exec("UPDATE projects SET upvotes = upvotes + 1 WHERE id=?", projectID)
-		} else {
-			tx.Exec("UPDATE projects SET downvotes = downvotes + 1 WHERE id=?", projectID)
+	var agents, projects, comments, votes counts
+	var renamed []rename
+	agentIDs := map[int]int{}
+	agentNames := map[int]string{} // imported agents stored under a new name
+	projectIDs := map[int]int{}
+	err := execWithRetry(func() error {
+		agents, projects, comments, votes = counts{}, counts{}, counts{}, counts{}
+		renamed = []rename{}
+		clear(agentIDs)
+		clear(agentNames)
+		clear(projectIDs)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
 		}
-	} else if err == nil {
-		if oldVote == req.Vote {
-			tx.Exec("DELETE FROM votes WHERE agent_id=? AND project_id=?", agent.ID, projectID)
-			if req.Vote == "up" {
-				tx.Exec("UPDATE projects SET upvotes = upvotes - 1 WHERE id=?", projectID)
-			} else {
-				tx.Exec("UPDATE projects SET downvotes = downvotes - 1 WHERE id=?", projectID)
+		defer tx.Rollback()
+		for _, a := range doc.Agents {
+			// Only an agent with the same name and the same api_key is the
+			// same account (system agents' keys differ per instance). A
+			// different agent under a taken name is imported under a fresh
+			// one instead of being merged into the local account.
+			var id int
+			var key string
+			if tx.QueryRow("SELECT id, api_key FROM agents WHERE LOWER(name)=LOWER(?)", a.Name).Scan(&id, &key) == nil {
+				system := strings.HasPrefix(key, systemKeyPrefix) && strings.HasPrefix(a.APIKey, systemKeyPrefix)
+				if system || hmac.Equal([]byte(key), []byte(a.APIKey)) {
+					agentIDs[a.ID] = id
+					agents.Skipped++
+					continue
+				}
+				name := a.Name + "-imported"
+				for n := 2; tx.QueryRow("SELECT id FROM agents WHERE LOWER(name)=LOWER(?)", name).Scan(&id) == nil; n++ {
+					name = fmt.Sprintf("%s-imported-%d", a.Name, n)
+				}
+				renamed = append(renamed, rename{a.Name, name})
+				agentNames[a.ID] = name
+				a.Name = name
 			}
-		} else {
-			tx.Exec("UPDATE votes SET vote_type=? WHERE agent_id=? AND project_id=?", req.Vote, agent.ID, projectID)
-			if req.Vote == "up" {
-				tx.Exec("UPDATE projects SET upvotes = upvotes + 1, downvotes = downvotes - 1 WHERE id=?", projectID)
-			} else {
-				tx.Exec("UPDATE projects SET upvotes = upvotes - 1, downvotes = downvotes + 1 WHERE id=?", projectID)
+			if tx.QueryRow("SELECT id FROM agents WHERE api_key=?", a.APIKey).Scan(&id) == nil {
+				a.APIKey = generateAPIKey()
 			}
+			res, err := tx.Exec("INSERT INTO agents (name, api_key, description, created_at) VALUES (?, ?, ?, ?)",
+				a.Name, a.APIKey, a.Description, importTime(a.CreatedAt))
+			if err != nil {
+				return fmt.Errorf("agent %q: %w", a.Name, err)
+			}
+			newID, _ := res.LastInsertId()
+			agentIDs[a.ID] = int(newID)
+			agents.Imported++
 		}
-	}
-
-	tx.Commit()
-	recordAction(agent.ID, "vote")
-	p, _ := getProject(projectID)
-	jsonResp(w, 200, p)
-}
-
-func handleAPIComments(w http.ResponseWriter, r *http.Request, projectID int) {
-	switch r.Method {
-	case "GET":
-		if _, err := getProject(projectID); err != nil {
-			jsonErr(w, 404, "project not found")
-			return
-		}
-		comments, err := getComments(projectID)
-		if err != nil {
-			jsonErr(w, 500, "database error")
-			return
-		}
-		if comments == nil {
-			comments = []Comment{}
-		}
-		jsonResp(w, 200, comments)
-
-	case "POST":
-		agent, err := authAgent(r)
-		if err != nil {
-			jsonErr(w, 401, err.Error())
-			return
-		}
-		if _, err := getProject(projectID); err != nil {
-			jsonErr(w, 404, "project not found")
-			return
-		}
-		// Rate limit: 10 comments per hour
-		if !checkRateLimit(agent.ID, "comment", 10) {
-			jsonErr(w, 429, "rate limit exceeded — max 10 comments per hour")
-			return
-		}
-		var req struct {
-			Body string `json:"body"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			jsonErr(w, 400, "invalid JSON body")
-			return
+		for _, p := range doc.Projects {
+			p.URL = normalizeURL(p.URL)
+			if name, ok := agentNames[p.SubmittedByID]; ok {
+				p.SubmittedBy = name
+			}
+			var id int
+			if tx.QueryRow("SELECT id FROM projects WHERE LOWER(url)=LOWER(?)", p.URL).Scan(&id) == nil {
+				projects.Skipped++
+				continue
+			}
+			if p.Source == "" {
+				p.Source = "import"
+			}
+			res, err := tx.Exec(`INSERT INTO projects (name, url, description, submitted_by, submitted_by_id, upvotes, downvotes, nsfw, source, created_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				p.Name, p.URL, p.Description, p.SubmittedBy, agentIDs[p.SubmittedByID], p.Upvotes, p.Downvotes, p.NSFW, p.Source, importTime(p.CreatedAt))
+			if err != nil {
+				return fmt.Errorf("project %q: %w", p.URL, err)
+			}
+			newID, _ := res.LastInsertId()
+			if err := setProjectTags(tx, int(newID), p.Tags); err != nil {
+				return err
+			}
+			projectIDs[p.ID] = int(newID)
+			projects.Imported++
 		}
-		req.Body = strings.TrimSpace(req.Body)
-		if req.Body == "" {
-			jsonErr(w, 400, "body is required")
-			return
+		for _, c := range doc.Comments {
+			projectID, ok := projectIDs[c.ProjectID]
+			if !ok {
+				comments.Skipped++
+				continue
+			}
+			if name, ok := agentNames[c.AgentID]; ok {
+				c.AgentName = name
+			}
+			if _, err := tx.Exec("INSERT INTO comments (project_id, agent_id, agent_name, body, created_at) VALUES (?, ?, ?, ?, ?)",
+				projectID, agentIDs[c.AgentID], c.AgentName, c.Body, importTime(c.CreatedAt)); err != nil {
+				return err
+			}
+			comments.Imported++
 		}
-		if len(req.Body) > 1000 {
-			jsonErr(w, 400, "comment must be 1000 characters or less")
-			return
+		// Imported projects keep their exported counters, so votes are
+		// copied as they are rather than applied.
+		for _, v := range doc.Votes {
+			projectID, ok := projectIDs[v.ProjectID]
+			if !ok {
+				votes.Skipped++
+				continue
+			}
+			res, err := tx.Exec("INSERT OR IGNORE INTO votes (agent_id, project_id, vote_type, created_at) VALUES (?, ?, ?, ?)",
+				agentIDs[v.AgentID], projectID, v.Vote, importTime(v.CreatedAt))
+			if err != nil {
+				return err
+			}
+			// An agent's existing vote on the project wins over the imported one.
+			if n, _ := res.RowsAffected(); n == 0 {
+				votes.Skipped++
+				continue
+			}
+			votes.Imported++
 		}
-
-		res, err := db.Exec(
-			"INSERT INTO comments (project_id, agent_id, agent_name, body) VALUES (?, ?, ?, ?)",
-			projectID, agent.ID, agent.Name, sanitize(req.Body),
-		)
-		if err != nil {
-			jsonErr(w, 500, "failed to create comment")
+		return tx.Commit()
+	})
+	if err != nil {
+		if isBusy(err) {
+			writeErr(w, err, "")
 			return
 		}
-		recordAction(agent.ID, "comment")
-
-		id, _ := res.LastInsertId()
-		var c Comment
-		var t string
-		db.QueryRow("SELECT id, project_id, agent_id, agent_name, body, created_at FROM comments WHERE id=?", id).
-			Scan(&c.ID, &c.ProjectID, &c.AgentID, &c.AgentName, &c.Body, &t)
-		c.CreatedAt = parseTime(t)
-		c.Body = html.UnescapeString(c.Body)
-		jsonResp(w, 201, c)
-
-	default:
-		jsonErr(w, 405, "method not allowed")
+		jsonErr(w, 409, "import failed, nothing was written: "+err.Error())
+		return
 	}
+	invalidateSimilar()
+	log.Printf("import: %d agents, %d projects, %d comments, %d votes", agents.Imported, projects.Imported, comments.Imported, votes.Imported)
+	jsonResp(w, 200, map[string]interface{}{
+		"agents":         agents,
+		"projects":       projects,
+		"comments":       comments,
+		"votes":          votes,
+		"renamed_agents": renamed,
+	})
 }
 
-func handleAPITraffic(w http.ResponseWriter, r *http.Request) {
+// handleAPICapabilities describes limits and options so clients can adapt
+// without hardcoding them. Everything here comes from the same values the
+// handlers enforce.
+func handleAPICapabilities(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		jsonErr(w, 405, "method not allowed")
 		return
 	}
-	stats := tracker.Stats()
-	// Add app stats
-	appStats := getStats()
-	stats["projects"] = appStats.TotalProjects
-	stats["agents"] = appStats.TotalAgents
-	stats["votes"] = appStats.TotalVotes
-	var commentCount int
-	db.QueryRow("SELECT COUNT(*) FROM comments").Scan(&commentCount)
-	stats["comments"] = commentCount
-	jsonResp(w, 200, stats)
+	sorts := make([]string, 0, len(projectSorts))
+	for name := range projectSorts {
+		sorts = append(sorts, name)
+	}
+	sort.Strings(sorts)
+	reasons := make([]string, 0, len(flagReasons))
+	for reason := range flagReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	versions := make([]string, 0, len(apiVersions))
+	for v := range apiVersions {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	fields := make([]string, 0, len(projectFields))
+	for f := range projectFields {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	jsonResp(w, 200, map[string]interface{}{
+		"rate_limits_per_hour":        rateLimits,
+		"ip_rate_limits_per_hour":     ipRateLimits,
+		"pow_difficulty":              powDifficulty,
+		"anonymous_submissions":       allowAnonSubmit,
+		"comment_cooldown_seconds":    int(commentCooldown.Seconds()),
+		"max_projects_per_agent":      maxProjectsPerAgent,
+		"comment_edit_window_seconds": int(commentEditWindow.Seconds()),
+		"similar_projects":            similarProjectsEnabled,
+		"submission_approval":         submissionWebhookURL != "",
+		"max_lengths": map[string]int{
+			"project_name":        maxProjectNameLen,
+			"project_url":         maxProjectURLLen,
+			"project_description": maxProjectDescLen,
+			"agent_name":          maxAgentNameLen,
+			"agent_description":   maxAgentDescLen,
+			"comment":             maxCommentLen,
+			"tag":                 maxTagLen,
+			"search_query":        maxSearchQueryLen,
+			"project_source":      maxSourceLen,
+		},
+		"min_lengths": map[string]int{
+			"project_description": minDescriptionLen,
+		},
+		"max_tags_per_project": maxTagsPerProject,
+		"max_batch_votes":      maxBatchVotes,
+		"max_agent_lookup":     maxAgentLookup,
+		"max_preview_comments": maxPreviewComments,
+		"pagination": map[string]int{
+			"default_limit":      min(defaultPageSize, maxPageSize),
+			"max_limit":          maxPageSize,
+			"max_search_results": min(maxSearchResults, maxPageSize),
+		},
+		"sort_options":   sorts,
+		"default_sort":   defaultSort,
+		"flag_reasons":   reasons,
+		"project_fields": fields,
+		"api_versions":   versions,
+		"vote_values":    []string{"up", "down"},
+		"score_weights":  map[string]float64{"up": upWeight, "down": downWeight},
+	})
 }
 
-func handleAPISearch(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
+// handleAPIRenderComment previews a comment exactly as the project page will
+// show it, without storing anything.
+func handleAPIRenderComment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
 		jsonErr(w, 405, "method not allowed")
 		return
 	}
-	q := strings.TrimSpace(r.URL.Query().Get("q"))
-	if q == "" {
-		jsonErr(w, 400, "q parameter is required")
+	agent, err := authAgent(r)
+	if err != nil {
+		authErr(w, err)
 		return
 	}
-	if len(q) > 200 {
-		jsonErr(w, 400, "search query too long")
+	if !checkRateLimit(agent.ID, "render", rateLimits["render"]) {
+		jsonErr(w, 429, fmt.Sprintf("rate limit exceeded — max %d previews per hour", rateLimits["render"]))
 		return
 	}
-	projects, err := getProjects(50, 0, q)
-	if err != nil {
-		jsonErr(w, 500, "search failed")
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonErrCode(w, 400, "invalid_json", "invalid JSON body")
 		return
 	}
-	if projects == nil {
-		projects = []Project{}
+	req.Body = strings.TrimSpace(req.Body)
+	if req.Body == "" {
+		jsonErr(w, 400, "body is required")
+		return
 	}
-	jsonResp(w, 200, projects)
+	if len(req.Body) > maxCommentLen {
+		jsonErr(w, 400, fmt.Sprintf("comment must be %d characters or less", maxCommentLen))
+		return
+	}
+	recordAction(agent.ID, "render")
+	jsonResp(w, 200, map[string]string{"html": string(renderMarkdown(req.Body))})
 }
@@ -0,0 +1,691 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// newTestServer serves the v1 API against a fresh SQLite database in a temp
+// directory, restoring the package's handles and in-memory caches afterwards.
+func newTestServer(t testing.TB) *httptest.Server {
+	t.Helper()
+	t.Setenv("DB_PATH", filepath.Join(t.TempDir(), "moltwiki.db"))
+	dsn, err := sqliteDSN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := sql.Open(sqliteDriver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDB, oldReadDB := db, readDB
+	db, readDB = conn, conn
+	resetCaches()
+	t.Cleanup(func() {
+		conn.Close()
+		db, readDB = oldDB, oldReadDB
+		resetCaches()
+	})
+	initDB()
+
+	mux := http.NewServeMux()
+	registerAPIv1(mux, apiVersions["v1"])
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// resetCaches drops in-memory state keyed by ids, which a fresh database reuses.
+func resetCaches() {
+	recentVotes.Lock()
+	clear(recentVotes.m)
+	recentVotes.Unlock()
+	authCache.Lock()
+	clear(authCache.m)
+	authCache.gen++
+	authCache.Unlock()
+	invalidateSimilar()
+}
+
+// call sends body (if not nil) as JSON with key as the bearer credential and
+// decodes the JSON response into out (if not nil), returning the status.
+func call(t testing.TB, srv *httptest.Server, method, path, key string, body, out interface{}) int {
+	t.Helper()
+	var rd io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, srv.URL+path, rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// register creates an agent and returns its api_key.
+func register(t testing.TB, srv *httptest.Server, name string) string {
+	t.Helper()
+	var resp struct {
+		APIKey string `json:"api_key"`
+	}
+	if code := call(t, srv, "POST", "/api/v1/agents/register", "", map[string]string{"name": name}, &resp); code != 201 {
+		t.Fatalf("register %s: status %d", name, code)
+	}
+	return resp.APIKey
+}
+
+func TestStatsTopEndpoints(t *testing.T) {
+	tr := &RequestTracker{endpoints: map[string]int64{}, timings: map[string]*endpointTiming{}}
+	for i := 0; i < 15; i++ {
+		tr.endpoints[fmt.Sprintf("/api/v1/e%02d", i)] = int64(i % 5)
+	}
+	b, _ := json.Marshal(tr.Stats()["top_endpoints"])
+	var top []struct {
+		Path  string `json:"path"`
+		Count int64  `json:"count"`
+	}
+	json.Unmarshal(b, &top)
+	if len(top) != 10 {
+		t.Fatalf("got %d top endpoints, want 10", len(top))
+	}
+	want := []string{"/api/v1/e04", "/api/v1/e09", "/api/v1/e14", "/api/v1/e03", "/api/v1/e08"}
+	for i, path := range want {
+		if top[i].Path != path {
+			t.Errorf("top_endpoints[%d] = %s, want %s", i, top[i].Path, path)
+		}
+	}
+	for i := 1; i < len(top); i++ {
+		if top[i].Count > top[i-1].Count {
+			t.Fatalf("top_endpoints not sorted by count: %+v", top)
+		}
+	}
+}
+
+func BenchmarkStatsLargeEndpointMap(b *testing.B) {
+	tr := &RequestTracker{endpoints: map[string]int64{}, timings: map[string]*endpointTiming{}}
+	for i := 0; i < 10000; i++ {
+		path := fmt.Sprintf("/api/v1/endpoint/%d", i)
+		tr.endpoints[path] = int64(i * 7919 % 10007)
+		tr.timings[path] = &endpointTiming{sum: time.Duration(i) * time.Millisecond, count: 1}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.Stats()
+	}
+}
+
+// rfc3339UTC is how every created_at should serialize: UTC, second precision.
+var rfc3339UTC = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z$`)
+
+func TestCreatedAtFormat(t *testing.T) {
+	srv := newTestServer(t)
+	key := register(t, srv, "alice")
+	var created struct {
+		ID int `json:"id"`
+	}
+	body := map[string]string{"name": "Timestamps", "url": "https://example.com/ts", "description": "checks created_at"}
+	if code := call(t, srv, "POST", "/api/v1/projects", key, body, &created); code != 201 {
+		t.Fatalf("create project: status %d", code)
+	}
+
+	var projects []map[string]interface{}
+	if code := call(t, srv, "GET", "/api/v1/projects?sort=new", "", nil, &projects); code != 200 {
+		t.Fatalf("list projects: status %d", code)
+	}
+	if len(projects) < 2 {
+		t.Fatalf("want the seeds and the new project, got %d projects", len(projects))
+	}
+	for _, p := range projects {
+		if s, _ := p["created_at"].(string); !rfc3339UTC.MatchString(s) {
+			t.Errorf("project %v created_at = %q, want RFC 3339 UTC", p["id"], s)
+		}
+	}
+
+	// Concatenating reads the stored text rather than the driver's parse of it.
+	var stored string
+	db.QueryRow("SELECT created_at || '' FROM projects WHERE id = ?", created.ID).Scan(&stored)
+	if _, err := time.Parse(dbTimeFormat, stored); err != nil {
+		t.Errorf("stored created_at %q is not in %q", stored, dbTimeFormat)
+	}
+	var seeded int
+	db.QueryRow("SELECT COUNT(*) FROM projects WHERE created_at NOT GLOB '[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9] [0-9][0-9]:[0-9][0-9]:[0-9][0-9]'").Scan(&seeded)
+	if seeded != 0 {
+		t.Errorf("%d projects stored created_at in another format", seeded)
+	}
+}
+
+// voteOn casts method on project id and returns the action and upvote count.
+func voteOn(t *testing.T, srv *httptest.Server, key, method string, id int, vote string) (string, int) {
+	t.Helper()
+	var body interface{}
+	if vote != "" {
+		body = map[string]string{"vote": vote}
+	}
+	var resp struct {
+		Action  string `json:"action"`
+		Upvotes int    `json:"upvotes"`
+	}
+	if code := call(t, srv, method, fmt.Sprintf("/api/v1/projects/%d/vote", id), key, body, &resp); code != 200 {
+		t.Fatalf("%s vote: status %d", method, code)
+	}
+	return resp.Action, resp.Upvotes
+}
+
+func TestVoteModes(t *testing.T) {
+	old := voteDuplicateWindow
+	voteDuplicateWindow = 0 // repeats below are deliberate, not resends
+	t.Cleanup(func() { voteDuplicateWindow = old })
+	srv := newTestServer(t)
+	owner := register(t, srv, "owner")
+	voter := register(t, srv, "voter")
+	var p struct {
+		ID int `json:"id"`
+	}
+	body := map[string]string{"name": "Votable", "url": "https://example.com/vote", "description": "gets voted on"}
+	if code := call(t, srv, "POST", "/api/v1/projects", owner, body, &p); code != 201 {
+		t.Fatalf("create project: status %d", code)
+	}
+
+	steps := []struct {
+		method, vote string
+		action       string
+		upvotes      int
+	}{
+		// POST toggles: the same vote twice clears it.
+		{"POST", "up", "created", 1},
+		{"POST", "up", "removed", 0},
+		// PUT is idempotent: the same vote twice leaves it in place.
+		{"PUT", "up", "created", 1},
+		{"PUT", "up", "unchanged", 1},
+		// DELETE is the explicit way to clear it.
+		{"DELETE", "", "removed", 0},
+		{"DELETE", "", "unchanged", 0},
+	}
+	for i, s := range steps {
+		action, up := voteOn(t, srv, voter, s.method, p.ID, s.vote)
+		if action != s.action || up != s.upvotes {
+			t.Fatalf("step %d: %s %q = (%s, %d upvotes), want (%s, %d)", i, s.method, s.vote, action, up, s.action, s.upvotes)
+		}
+	}
+
+	// The final DELETE found nothing to remove and must not spend a vote.
+	var spent int
+	db.QueryRow("SELECT COUNT(*) FROM rate_limits WHERE action_type = 'vote'").Scan(&spent)
+	if want := len(steps) - 1; spent != want {
+		t.Errorf("vote rate limit entries = %d, want %d", spent, want)
+	}
+}
+
+func TestSearchRanksNameMatchesFirst(t *testing.T) {
+	srv := newTestServer(t)
+	owner := register(t, srv, "owner")
+	voter := register(t, srv, "voter")
+	projects := []map[string]string{
+		{"name": "Stripes", "url": "https://example.com/stripes", "description": "a long description that mentions zebra only in passing"},
+		{"name": "Zebra Tools", "url": "https://example.com/zebra", "description": "utilities for agents"},
+	}
+	ids := make([]int, len(projects))
+	for i, body := range projects {
+		var p struct {
+			ID int `json:"id"`
+		}
+		if code := call(t, srv, "POST", "/api/v1/projects", owner, body, &p); code != 201 {
+			t.Fatalf("create project: status %d", code)
+		}
+		ids[i] = p.ID
+	}
+	// Without name boosting the better-voted description match would lead.
+	voteOn(t, srv, voter, "PUT", ids[0], "up")
+
+	var results []struct {
+		ID int `json:"id"`
+	}
+	if code := call(t, srv, "GET", "/api/v1/search?q=zebra", "", nil, &results); code != 200 {
+		t.Fatalf("search: status %d", code)
+	}
+	if len(results) != 2 || results[0].ID != ids[1] || results[1].ID != ids[0] {
+		t.Fatalf("search results = %+v, want project %d (name match) before %d", results, ids[1], ids[0])
+	}
+}
+
+func BenchmarkSearch(b *testing.B) {
+	newTestServer(b)
+	tx, err := db.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		name, desc := fmt.Sprintf("Project %d", i), "an agent tool"
+		if i%10 == 0 {
+			name = fmt.Sprintf("Search Helper %d", i)
+		} else if i%10 == 1 {
+			desc = "a tool that helps you search"
+		}
+		tx.Exec("INSERT INTO projects (name, url, description, upvotes, created_at) VALUES (?, ?, ?, ?, ?)",
+			name, fmt.Sprintf("https://example.com/%d", i), desc, i%50, dbNow())
+	}
+	if err := tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := getProjects(db, maxSearchResults, 0, ProjectFilter{Search: "search"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAuditCoversModeration(t *testing.T) {
+	old := auditLogEnabled
+	auditLogEnabled = true
+	t.Cleanup(func() { auditLogEnabled = old })
+	srv := newTestServer(t)
+	owner := register(t, srv, "owner")
+	voter := register(t, srv, "voter")
+	var p struct {
+		ID int `json:"id"`
+	}
+	body := map[string]string{"name": "Audited", "url": "https://example.com/audit", "description": "gets audited"}
+	if code := call(t, srv, "POST", "/api/v1/projects", owner, body, &p); code != 201 {
+		t.Fatalf("create project: status %d", code)
+	}
+	var c struct {
+		ID int `json:"id"`
+	}
+	if code := call(t, srv, "POST", fmt.Sprintf("/api/v1/projects/%d/comments", p.ID), voter, map[string]string{"body": "nice one"}, &c); code != 201 {
+		t.Fatalf("comment: status %d", code)
+	}
+	if code := call(t, srv, "PUT", fmt.Sprintf("/api/v1/projects/%d/comments/%d/pin", p.ID, c.ID), owner, nil, nil); code != 200 {
+		t.Fatalf("pin: status %d", code)
+	}
+	if code := call(t, srv, "POST", fmt.Sprintf("/api/v1/projects/%d/flag", p.ID), voter, map[string]string{"reason": "spam"}, nil); code != 201 {
+		t.Fatalf("flag: status %d", code)
+	}
+	voteOn(t, srv, voter, "PUT", p.ID, "up")
+
+	for _, action := range []string{"comment.pin", "project.flag", "vote.create"} {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE action = ?", action).Scan(&n)
+		if n != 1 {
+			t.Errorf("%d %s audit entries, want 1", n, action)
+		}
+	}
+
+	// A vote whose audit entry can't be written must not be kept either.
+	if _, err := db.Exec("DROP TABLE audit_log"); err != nil {
+		t.Fatal(err)
+	}
+	if code := call(t, srv, "PUT", fmt.Sprintf("/api/v1/projects/%d/vote", p.ID), voter, map[string]string{"vote": "down"}, nil); code != 500 {
+		t.Fatalf("vote without an audit log: status %d, want 500", code)
+	}
+	var vote string
+	db.QueryRow("SELECT vote_type FROM votes WHERE project_id = ?", p.ID).Scan(&vote)
+	if vote != "up" {
+		t.Errorf("stored vote = %q after a failed audit, want the earlier upvote", vote)
+	}
+}
+
+func TestBrokenFlagsQueueOneLinkCheck(t *testing.T) {
+	old := brokenFlagThreshold
+	brokenFlagThreshold = 0 // the first broken flag is enough
+	t.Cleanup(func() { brokenFlagThreshold = old })
+	srv := newTestServer(t)
+	owner := register(t, srv, "owner")
+	var p struct {
+		ID int `json:"id"`
+	}
+	body := map[string]string{"name": "Flaky", "url": "https://example.com/flaky", "description": "might be down"}
+	if code := call(t, srv, "POST", "/api/v1/projects", owner, body, &p); code != 201 {
+		t.Fatalf("create project: status %d", code)
+	}
+	for len(linkCheckQueue) > 0 {
+		<-linkCheckQueue
+	}
+	for _, name := range []string{"first", "second", "third"} {
+		key := register(t, srv, name)
+		if code := call(t, srv, "POST", fmt.Sprintf("/api/v1/projects/%d/flag", p.ID), key, map[string]string{"reason": "broken"}, nil); code != 201 {
+			t.Fatalf("flag: status %d", code)
+		}
+	}
+	if n := len(linkCheckQueue); n != 1 {
+		t.Fatalf("%d link checks queued, want 1", n)
+	}
+	if id := <-linkCheckQueue; id != p.ID {
+		t.Errorf("queued project %d, want %d", id, p.ID)
+	}
+}
+
+func TestCheckLinkRefusesPrivateAddresses(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer local.Close()
+	if status := checkLink(linkCheckClient(), local.URL); status != "broken" {
+		t.Errorf("checkLink(%s) = %s, want broken", local.URL, status)
+	}
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "169.254.169.254", "::1", "0.0.0.0", "192.168.0.1"} {
+		if publicIP(net.ParseIP(ip)) {
+			t.Errorf("publicIP(%s) = true", ip)
+		}
+	}
+	if !publicIP(net.ParseIP("93.184.216.34")) {
+		t.Error("publicIP(93.184.216.34) = false")
+	}
+}
+
+func TestAgentLookupIgnoresCase(t *testing.T) {
+	srv := newTestServer(t)
+	register(t, srv, "MixedCase")
+	var agents []struct {
+		Name string `json:"name"`
+	}
+	if code := call(t, srv, "GET", "/api/v1/agents?names=mixedcase,MIXEDCASE,nobody", "", nil, &agents); code != 200 {
+		t.Fatalf("lookup: status %d", code)
+	}
+	if len(agents) != 1 || agents[0].Name != "MixedCase" {
+		t.Errorf("agents = %+v, want just MixedCase", agents)
+	}
+	if code := call(t, srv, "GET", "/api/v1/agents/mixedcase/comments", "", nil, nil); code != 200 {
+		t.Errorf("comments by lowercased name: status %d, want 200", code)
+	}
+}
+
+func TestReadOnlyAllowsAdminMaintenance(t *testing.T) {
+	t.Setenv("ADMIN_KEY", "admin-secret")
+	srv := newTestServer(t)
+	key := register(t, srv, "writer")
+	readOnly = true
+	t.Cleanup(func() { readOnly = false })
+
+	body := map[string]string{"name": "Paused", "url": "https://example.com/paused", "description": "submitted while read-only"}
+	if code := call(t, srv, "POST", "/api/v1/projects", key, body, nil); code != 503 {
+		t.Errorf("submit while read-only: status %d, want 503", code)
+	}
+	if code := call(t, srv, "POST", "/api/v1/admin/maintenance", key, nil, nil); code != 503 {
+		t.Errorf("maintenance without the admin key: status %d, want 503", code)
+	}
+	if code := call(t, srv, "POST", "/api/v1/admin/maintenance", "admin-secret", nil, nil); code != 200 {
+		t.Errorf("admin maintenance while read-only: status %d, want 200", code)
+	}
+}
+
+func TestUndoThenRecastVote(t *testing.T) {
+	srv := newTestServer(t)
+	owner := register(t, srv, "owner")
+	voter := register(t, srv, "voter")
+	var p struct {
+		ID int `json:"id"`
+	}
+	body := map[string]string{"name": "Undoable", "url": "https://example.com/undo", "description": "voted, undone, voted again"}
+	if code := call(t, srv, "POST", "/api/v1/projects", owner, body, &p); code != 201 {
+		t.Fatalf("create project: status %d", code)
+	}
+	if action, _ := voteOn(t, srv, voter, "POST", p.ID, "up"); action != "created" {
+		t.Fatalf("first vote: %s, want created", action)
+	}
+	if code := call(t, srv, "DELETE", "/api/v1/agents/me/votes/last", voter, nil, nil); code != 200 {
+		t.Fatalf("undo: status %d", code)
+	}
+	// Well within VOTE_DUPLICATE_WINDOW, but the undone vote is no longer standing.
+	if action, up := voteOn(t, srv, voter, "POST", p.ID, "up"); action != "created" || up != 1 {
+		t.Errorf("recast after undo: (%s, %d upvotes), want (created, 1)", action, up)
+	}
+}
+
+func TestVoteReportsBusyDatabase(t *testing.T) {
+	t.Setenv("SQLITE_BUSY_TIMEOUT", "0")
+	srv := newTestServer(t)
+	owner := register(t, srv, "owner")
+	voter := register(t, srv, "voter")
+	var p struct {
+		ID int `json:"id"`
+	}
+	body := map[string]string{"name": "Contended", "url": "https://example.com/busy", "description": "voted on under load"}
+	if code := call(t, srv, "POST", "/api/v1/projects", owner, body, &p); code != 201 {
+		t.Fatalf("create project: status %d", code)
+	}
+
+	// Another connection holding the write lock outlasts every retry.
+	dsn, _ := sqliteDSN()
+	other, err := sql.Open(sqliteDriver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	lock, err := other.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Rollback()
+	if _, err := lock.Exec("UPDATE projects SET views = views WHERE id = ?", p.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp struct {
+		Code string `json:"code"`
+	}
+	if code := call(t, srv, "PUT", fmt.Sprintf("/api/v1/projects/%d/vote", p.ID), voter, map[string]string{"vote": "up"}, &resp); code != 503 || resp.Code != "database_busy" {
+		t.Errorf("vote while locked: status %d, code %q, want 503 database_busy", code, resp.Code)
+	}
+}
+
+func TestRecentAgentsUnescapeNames(t *testing.T) {
+	srv := newTestServer(t)
+	if code := call(t, srv, "POST", "/api/v1/agents/register", "", map[string]string{"name": "O'Brien", "description": "builds <tools> & more"}, nil); code != 201 {
+		t.Fatalf("register: status %d", code)
+	}
+	var agents []struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if code := call(t, srv, "GET", "/api/v1/agents/recent", "", nil, &agents); code != 200 {
+		t.Fatalf("recent agents: status %d", code)
+	}
+	if len(agents) != 1 || agents[0].Name != "O'Brien" || agents[0].Description != "builds <tools> & more" {
+		t.Errorf("recent agents = %+v, want O'Brien as registered", agents)
+	}
+}
+
+func TestContributorsUnescapeNames(t *testing.T) {
+	srv := newTestServer(t)
+	key := register(t, srv, "O'Brien")
+	body := map[string]string{"name": "Quoted", "url": "https://example.com/quoted", "description": "submitted by O'Brien"}
+	if code := call(t, srv, "POST", "/api/v1/projects", key, body, nil); code != 201 {
+		t.Fatalf("create project: status %d", code)
+	}
+	var contributors []struct {
+		Name string `json:"name"`
+	}
+	if code := call(t, srv, "GET", "/api/v1/contributors", "", nil, &contributors); code != 200 {
+		t.Fatalf("contributors: status %d", code)
+	}
+	if len(contributors) != 1 || contributors[0].Name != "O'Brien" {
+		t.Errorf("contributors = %+v, want O'Brien", contributors)
+	}
+}
+
+func TestVotersUnescapeNames(t *testing.T) {
+	srv := newTestServer(t)
+	owner := register(t, srv, "owner")
+	voter := register(t, srv, "O'Brien")
+	var p struct {
+		ID int `json:"id"`
+	}
+	body := map[string]string{"name": "Liked", "url": "https://example.com/liked", "description": "upvoted by O'Brien"}
+	if code := call(t, srv, "POST", "/api/v1/projects", owner, body, &p); code != 201 {
+		t.Fatalf("create project: status %d", code)
+	}
+	voteOn(t, srv, voter, "PUT", p.ID, "up")
+	var resp struct {
+		Upvoters []string `json:"upvoters"`
+	}
+	if code := call(t, srv, "GET", fmt.Sprintf("/api/v1/projects/%d/voters", p.ID), owner, nil, &resp); code != 200 {
+		t.Fatalf("voters: status %d", code)
+	}
+	if len(resp.Upvoters) != 1 || resp.Upvoters[0] != "O'Brien" {
+		t.Errorf("upvoters = %q, want [O'Brien]", resp.Upvoters)
+	}
+}
+
+func TestUnpinOnlyClearsThatComment(t *testing.T) {
+	oldAudit, oldCooldown := auditLogEnabled, commentCooldown
+	auditLogEnabled, commentCooldown = true, 0
+	t.Cleanup(func() { auditLogEnabled, commentCooldown = oldAudit, oldCooldown })
+	srv := newTestServer(t)
+	owner := register(t, srv, "owner")
+	reader := register(t, srv, "reader")
+	var p struct {
+		ID int `json:"id"`
+	}
+	body := map[string]string{"name": "Pinned", "url": "https://example.com/pinned", "description": "has a pinned comment"}
+	if code := call(t, srv, "POST", "/api/v1/projects", owner, body, &p); code != 201 {
+		t.Fatalf("create project: status %d", code)
+	}
+	ids := make([]int, 2)
+	for i := range ids {
+		var c struct {
+			ID int `json:"id"`
+		}
+		if code := call(t, srv, "POST", fmt.Sprintf("/api/v1/projects/%d/comments", p.ID), reader, map[string]string{"body": fmt.Sprintf("comment %d", i)}, &c); code != 201 {
+			t.Fatalf("comment: status %d", code)
+		}
+		ids[i] = c.ID
+	}
+	pinPath := func(id int) string { return fmt.Sprintf("/api/v1/projects/%d/comments/%d/pin", p.ID, id) }
+	if code := call(t, srv, "PUT", pinPath(ids[0]), owner, nil, nil); code != 200 {
+		t.Fatalf("pin: status %d", code)
+	}
+	if code := call(t, srv, "DELETE", pinPath(ids[1]), owner, nil, nil); code != 409 {
+		t.Errorf("unpin an unpinned comment: status %d, want 409", code)
+	}
+	var pinned int
+	db.QueryRow("SELECT pinned FROM comments WHERE id = ?", ids[0]).Scan(&pinned)
+	if pinned != 1 {
+		t.Error("unpinning another comment cleared the pin")
+	}
+	var unpins int
+	db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE action = 'comment.unpin'").Scan(&unpins)
+	if unpins != 0 {
+		t.Errorf("%d comment.unpin audit entries for a no-op, want 0", unpins)
+	}
+	if code := call(t, srv, "DELETE", pinPath(ids[0]), owner, nil, nil); code != 200 {
+		t.Errorf("unpin the pinned comment: status %d, want 200", code)
+	}
+}
+
+func TestVoteBatchRejectsRepeatedProjects(t *testing.T) {
+	srv := newTestServer(t)
+	owner := register(t, srv, "owner")
+	voter := register(t, srv, "voter")
+	var p struct {
+		ID int `json:"id"`
+	}
+	body := map[string]string{"name": "Batched", "url": "https://example.com/batched", "description": "voted on in a batch"}
+	if code := call(t, srv, "POST", "/api/v1/projects", owner, body, &p); code != 201 {
+		t.Fatalf("create project: status %d", code)
+	}
+	batch := map[string]interface{}{"votes": []map[string]interface{}{
+		{"project_id": p.ID, "vote": "up"},
+		{"project_id": p.ID, "vote": "up"},
+	}}
+	if code := call(t, srv, "POST", "/api/v1/votes/batch", voter, batch, nil); code != 400 {
+		t.Errorf("batch repeating a project: status %d, want 400", code)
+	}
+	var spent int
+	db.QueryRow("SELECT COUNT(*) FROM rate_limits WHERE action_type = 'vote'").Scan(&spent)
+	if spent != 0 {
+		t.Errorf("rejected batch spent %d votes", spent)
+	}
+}
+
+func TestImportCountsIgnoredVotesAsSkipped(t *testing.T) {
+	t.Setenv("ADMIN_KEY", "admin-secret")
+	src := newTestServer(t)
+	owner := register(t, src, "owner")
+	voter := register(t, src, "voter")
+	var p struct {
+		ID int `json:"id"`
+	}
+	body := map[string]string{"name": "Exported", "url": "https://example.com/exported", "description": "moves between servers"}
+	if code := call(t, src, "POST", "/api/v1/projects", owner, body, &p); code != 201 {
+		t.Fatalf("create project: status %d", code)
+	}
+	voteOn(t, src, voter, "PUT", p.ID, "up")
+	var doc map[string]interface{}
+	if code := call(t, src, "GET", "/api/v1/admin/export", "admin-secret", nil, &doc); code != 200 {
+		t.Fatalf("export: status %d", code)
+	}
+	// The same vote twice: the second can only be ignored.
+	votes := doc["votes"].([]interface{})
+	if len(votes) != 1 {
+		t.Fatalf("exported %d votes, want 1", len(votes))
+	}
+	doc["votes"] = append(votes, votes[0])
+
+	dst := newTestServer(t)
+	var resp struct {
+		Votes struct {
+			Imported int `json:"imported"`
+			Skipped  int `json:"skipped"`
+		} `json:"votes"`
+	}
+	if code := call(t, dst, "POST", "/api/v1/admin/import", "admin-secret", doc, &resp); code != 200 {
+		t.Fatalf("import: status %d", code)
+	}
+	if resp.Votes.Imported != 1 || resp.Votes.Skipped != 1 {
+		t.Errorf("votes imported %d, skipped %d; want 1 and 1", resp.Votes.Imported, resp.Votes.Skipped)
+	}
+}
+
+func TestAdminURLEditIsValidated(t *testing.T) {
+	t.Setenv("ADMIN_KEY", "admin-secret")
+	srv := newTestServer(t)
+	owner := register(t, srv, "owner")
+	ids := make([]int, 2)
+	for i := range ids {
+		var p struct {
+			ID int `json:"id"`
+		}
+		body := map[string]string{"name": fmt.Sprintf("Edited %d", i), "url": fmt.Sprintf("https://example.com/edited%d", i), "description": "has its URL edited"}
+		if code := call(t, srv, "POST", "/api/v1/projects", owner, body, &p); code != 201 {
+			t.Fatalf("create project: status %d", code)
+		}
+		ids[i] = p.ID
+	}
+	path := fmt.Sprintf("/api/v1/projects/%d", ids[1])
+	if code := call(t, srv, "PATCH", path, "admin-secret", map[string]string{"url": "javascript:alert(1)"}, nil); code != 400 {
+		t.Errorf("invalid URL: status %d, want 400", code)
+	}
+	if code := call(t, srv, "PATCH", path, "admin-secret", map[string]string{"url": "https://EXAMPLE.com/edited0"}, nil); code != 409 {
+		t.Errorf("another project's URL: status %d, want 409", code)
+	}
+	var p struct {
+		URL string `json:"url"`
+	}
+	if code := call(t, srv, "PATCH", path, "admin-secret", map[string]string{"url": " https://example.com/moved "}, &p); code != 200 || p.URL != normalizeURL("https://example.com/moved") {
+		t.Errorf("valid URL: status %d, url %q", code, p.URL)
+	}
+}